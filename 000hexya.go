@@ -4,19 +4,35 @@
 package sale
 
 import (
+	"net/http"
+
 	_ "github.com/hexya-addons/account"
 	_ "github.com/hexya-addons/procurement"
 	_ "github.com/hexya-addons/saleTeams"
 	"github.com/hexya-addons/web/controllers"
+	hexyaControllers "github.com/hexya-erp/hexya/src/controllers"
 	"github.com/hexya-erp/hexya/src/server"
+	"github.com/hexya-erp/hexya/src/tools/logging"
 )
 
 const MODULE_NAME = "sale"
 
+var log logging.Logger
+
 func init() {
+	log = logging.GetLogger("sale")
 	server.RegisterModule(&server.Module{
-		Name:     MODULE_NAME,
-		PostInit: func() {},
+		Name: MODULE_NAME,
+		PreInit: func() {
+			report := hexyaControllers.Registry.AddGroup("/sale/report")
+			{
+				report.AddMiddleWare(controllers.LoginRequired)
+				report.AddController(http.MethodGet, "/saleorder/:ids", ReportSaleOrder)
+			}
+		},
+		PostInit: func() {
+			startScheduledJobs()
+		},
 	})
 
 	controllers.BackendCSS = append(controllers.BackendCSS, "/static/sale/src/css/sale.css")
@@ -4,6 +4,7 @@
 package sale
 
 import (
+	"github.com/hexya-addons/sale/saletypes"
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/pool/h"
 	"github.com/hexya-erp/pool/m"
@@ -48,54 +49,119 @@ func init() {
 			return data
 		})
 
-	//h.AccountInvoice().Methods().ActionInvoicePaid().Extend("",
-	//	func(rs m.AccountInvoiceSet) bool {
-	//		res := rs.Super().ActionInvoicePaid()
-	//		todo := make(map[struct {
-	//			order h.SaleOrderSet
-	//			name  string
-	//		}]bool)
-	//		for _, invoice := range rs.Records() {
-	//			for _, line := range invoice.InvoiceLines().Records() {
-	//				for _, saleLine := range line.SaleLines {
-	//					todo[struct {
-	//						order h.SaleOrderSet
-	//						name  string
-	//					}{
-	//						order: saleLine.Order(), name: invoice.Number()}] = true
-	//				}
-	//			}
-	//		}
-	//		for key := range todo {
-	//			key.order.MessagePost(rs.T("Invoice %s paid", key.name))
-	//		}
-	//		return res
-	//	})
-
-	//h.AccountInvoice().Methods().OrderLinesLayouted().DeclareMethod(
-	//	`OrderLinesLayouted returns this sale order lines ordered by sale_layout_category sequence.
-	//	Used to render the report.`,
-	//	func(rs m.AccountInvoiceSet) {
-	//		//@api.multi
-	//		/*
-	//		  self.ensure_one()
-	//		  report_pages = [[]]
-	//		  for category, lines in groupby(self.invoice_line_ids, lambda l: l.layout_category_id):
-	//		      # If last added category induced a pagebreak, this one will be on a new page
-	//		      if report_pages[-1] and report_pages[-1][-1]['pagebreak']:
-	//		          report_pages.append([])
-	//		      # Append category to current report page
-	//		      report_pages[-1].append({
-	//		          'name': category and category.name or 'Uncategorized',
-	//		          'subtotal': category and category.subtotal,
-	//		          'pagebreak': category and category.pagebreak,
-	//		          'lines': list(lines)
-	//		      })
-	//
-	//		  return report_pages
-	//
-	//		*/
-	//	})
+	h.AccountInvoice().Methods().SaleOrders().DeclareMethod(
+		`SaleOrders returns the sale orders from which the lines of the invoices of this RecordSet originate.`,
+		func(rs m.AccountInvoiceSet) m.SaleOrderSet {
+			orders := h.SaleOrder().NewSet(rs.Env())
+			for _, invoice := range rs.Records() {
+				for _, line := range invoice.InvoiceLines().Records() {
+					for _, saleLine := range line.SaleLines().Records() {
+						orders = orders.Union(saleLine.Order())
+					}
+				}
+			}
+			return orders
+		})
+
+	h.AccountInvoice().Methods().ActionInvoicePaid().Extend("",
+		func(rs m.AccountInvoiceSet) bool {
+			toPay := rs.Filtered(func(r m.AccountInvoiceSet) bool { return r.State() != "paid" })
+			res := rs.Super().ActionInvoicePaid()
+			for _, invoice := range toPay.Records() {
+				for _, order := range invoice.SaleOrders().Records() {
+					order.LogChange(h.SaleOrderLog().NewData().
+						SetKind("payment").
+						SetNewValue(invoice.Number()).
+						SetMessage(rs.T("Invoice %s paid", invoice.Number())))
+				}
+			}
+			return res
+		})
+
+	h.AccountInvoice().Methods().Write().Extend("",
+		func(rs m.AccountInvoiceSet, data m.AccountInvoiceData) bool {
+			if !data.HasResidual() {
+				return rs.Super().Write(data)
+			}
+			residuals := make(map[int64]float64)
+			for _, invoice := range rs.Records() {
+				if invoice.State() == "open" {
+					residuals[invoice.ID()] = invoice.Residual()
+				}
+			}
+			res := rs.Super().Write(data)
+			// Full payments are recorded by ActionInvoicePaid
+			for _, invoice := range rs.Records() {
+				oldResidual, ok := residuals[invoice.ID()]
+				currency := invoice.Currency()
+				if !ok || currency.IsZero(invoice.Residual()) || currency.CompareAmounts(invoice.Residual(), oldResidual) >= 0 {
+					continue
+				}
+				for _, order := range invoice.SaleOrders().Records() {
+					order.LogChange(h.SaleOrderLog().NewData().
+						SetKind("payment").
+						SetOldValue(formatAmount(oldResidual, currency)).
+						SetNewValue(formatAmount(invoice.Residual(), currency)).
+						SetMessage(rs.T("Invoice %s partially paid, %s remaining",
+							invoice.Number(), formatAmount(invoice.Residual(), currency))))
+				}
+			}
+			return res
+		})
+
+	h.AccountInvoice().Methods().ActionInvoiceReOpen().Extend("",
+		func(rs m.AccountInvoiceSet) bool {
+			res := rs.Super().ActionInvoiceReOpen()
+			for _, invoice := range rs.Records() {
+				for _, order := range invoice.SaleOrders().Records() {
+					order.LogChange(h.SaleOrderLog().NewData().
+						SetKind("payment").
+						SetOldValue(invoice.Number()).
+						SetMessage(rs.T("Invoice %s is no longer paid", invoice.Number())))
+				}
+			}
+			return res
+		})
+
+	h.AccountInvoice().Methods().OrderLinesLayouted().DeclareMethod(
+		`OrderLinesLayouted returns this invoice lines classified by sale_layout_category and separated in
+		pages according to the category pagebreaks. Used to render the report.`,
+		func(rs m.AccountInvoiceSet) []saletypes.LayoutPage {
+			rs.EnsureOne()
+			pages := []saletypes.LayoutPage{{}}
+			category := h.SaleLayoutCategory().NewSet(rs.Env())
+			for i, line := range rs.InvoiceLines().Records() {
+				if i == 0 || !line.LayoutCategory().Equals(category) {
+					category = line.LayoutCategory()
+					// If last added category induced a pagebreak, this one will be on a new page
+					lastPage := pages[len(pages)-1]
+					if len(lastPage) > 0 && lastPage[len(lastPage)-1].Pagebreak {
+						pages = append(pages, saletypes.LayoutPage{})
+					}
+					name := rs.T("Uncategorized")
+					if category.IsNotEmpty() {
+						name = category.Name()
+					}
+					pages[len(pages)-1] = append(pages[len(pages)-1], saletypes.LayoutSection{
+						Name:      name,
+						Subtotal:  category.IsNotEmpty() && category.Subtotal(),
+						Pagebreak: category.IsNotEmpty() && category.Pagebreak(),
+						Default:   category.IsEmpty(),
+					})
+				}
+				page := pages[len(pages)-1]
+				section := &page[len(page)-1]
+				section.LineIDs = append(section.LineIDs, line.ID())
+				section.SubtotalAmount += line.PriceSubtotal()
+			}
+			return pages
+		})
+
+	h.AccountInvoice().Methods().LayoutSectionLines().DeclareMethod(
+		`LayoutSectionLines returns the lines of the given section of the layout of this invoice.`,
+		func(rs m.AccountInvoiceSet, section saletypes.LayoutSection) m.AccountInvoiceLineSet {
+			return h.AccountInvoiceLine().Browse(rs.Env(), section.LineIDs)
+		})
 
 	h.AccountInvoice().Methods().GetDeliveryPartner().Extend("",
 		func(rs m.AccountInvoiceSet, partner m.PartnerSet) m.PartnerSet {
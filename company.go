@@ -12,6 +12,9 @@ func init() {
 
 	h.Company().AddFields(map[string]models.FieldDefinition{
 		"SaleNote": models.TextField{String: "Default Terms and Conditions", Translate: true},
+		"QuotationValidityDays": models.IntegerField{String: "Default Quotation Validity (Days)", GoType: new(int),
+			Default: models.DefaultValue(30),
+			Help:    "Number of days quotations are valid by default. Set to 0 for quotations without expiration date."},
 	})
 
 }
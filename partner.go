@@ -5,6 +5,7 @@ package sale
 
 import (
 	"github.com/hexya-addons/base"
+	"github.com/hexya-addons/sale/saletypes"
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/pool/h"
 	"github.com/hexya-erp/pool/m"
@@ -30,4 +31,31 @@ func init() {
 			return h.Partner().NewData().SetSaleOrderCount(count)
 		})
 
+	h.Partner().Methods().GetSaleWarning().DeclareMethod(
+		`GetSaleWarning returns the warning to display when selling to this partner.
+		If this partner has no warning, the warning of its parent company is used.
+		A partner is also blocked if its parent company is blocked.`,
+		func(rs m.PartnerSet) saletypes.SaleWarning {
+			if rs.IsEmpty() {
+				return saletypes.SaleWarning{}
+			}
+			rs.EnsureOne()
+			partner := rs
+			if partner.SaleWarn() == "no-message" && partner.Parent().IsNotEmpty() {
+				partner = partner.Parent()
+			}
+			if partner.SaleWarn() == "no-message" {
+				return saletypes.SaleWarning{}
+			}
+			// Block if partner only has warning but parent company is blocked
+			if partner.SaleWarn() != "block" && partner.Parent().IsNotEmpty() && partner.Parent().SaleWarn() == "block" {
+				partner = partner.Parent()
+			}
+			return saletypes.SaleWarning{
+				Title:    rs.T("Warning for %s", partner.Name()),
+				Message:  partner.SaleWarnMsg(),
+				Blocking: partner.SaleWarn() == "block",
+			}
+		})
+
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/hexya-erp/hexya/src/models/types/dates"
 	"github.com/hexya-erp/hexya/src/tests"
 	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
 	"github.com/hexya-erp/pool/q"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -65,6 +66,68 @@ func TestOnChangeProduct(t *testing.T) {
 				So(res.HasPriceUnit(), ShouldBeTrue)
 				So(res.PriceUnit(), ShouldEqual, 100)
 			})
+			Convey("Test changing the fiscal position recomputes the taxes of the lines", func() {
+				uom := h.ProductUom().Search(env, q.ProductUom().Name().Equals("Unit(s)"))
+				priceList := h.ProductPricelist().Search(env, q.ProductPricelist().Name().Equals("Public Pricelist"))
+				partner := h.Partner().Create(env, h.Partner().NewData().SetName("George"))
+				taxInclude := h.AccountTax().Create(env, h.AccountTax().NewData().
+					SetName("Include tax").
+					SetAmount(21).
+					SetPriceInclude(true).
+					SetTypeTaxUse("sale"))
+				taxExclude := h.AccountTax().Create(env, h.AccountTax().NewData().
+					SetName("Exclude tax").
+					SetAmount(0).
+					SetTypeTaxUse("sale"))
+				productTmpl := h.ProductTemplate().Create(env, h.ProductTemplate().NewData().
+					SetName("Voiture").
+					SetListPrice(121).
+					SetTaxes(taxInclude).
+					SetUom(uom).
+					SetUomPo(uom))
+				product := h.ProductProduct().Create(env, h.ProductProduct().NewData().SetProductTmpl(productTmpl))
+				fp := h.AccountFiscalPosition().Create(env, h.AccountFiscalPosition().NewData().
+					SetName("fiscal position").
+					SetSequence(1))
+				h.AccountFiscalPositionTax().Create(env, h.AccountFiscalPositionTax().NewData().
+					SetPosition(fp).
+					SetTaxSrc(taxInclude).
+					SetTaxDest(taxExclude))
+				order := h.SaleOrder().Create(env, h.SaleOrder().NewData().
+					SetPartner(partner).
+					SetPricelist(priceList).
+					CreateOrderLine(
+						h.SaleOrderLine().NewData().
+							SetName(product.Name()).
+							SetProduct(product).
+							SetProductUomQty(1).
+							SetProductUom(uom).
+							SetPriceUnit(121).
+							SetTax(taxInclude)))
+				So(order.AmountTax(), ShouldEqual, 21)
+				So(order.AmountTotal(), ShouldEqual, 121)
+
+				order.SetFiscalPosition(fp)
+				So(order.OrderLine().Tax().Equals(taxExclude), ShouldBeTrue)
+				So(order.AmountTax(), ShouldEqual, 0)
+				So(order.AmountTotal(), ShouldEqual, 121)
+
+				order.OrderLine().SetTax(taxInclude)
+				So(order.ActionRecomputeTaxes(), ShouldBeTrue)
+				So(order.OrderLine().Tax().Equals(taxExclude), ShouldBeTrue)
+
+				order.OrderLine().SetTax(taxInclude)
+				onchange := order.ComputeTax()
+				So(onchange.OrderLine().Equals(order.OrderLine()), ShouldBeTrue)
+				So(onchange.OrderLine().Tax().Equals(taxExclude), ShouldBeTrue)
+				So(onchange.AmountTax(), ShouldEqual, 0)
+
+				order.ActionConfirm()
+				So(func() { order.ActionRecomputeTaxes() }, ShouldPanic)
+				order.SetFiscalPosition(h.AccountFiscalPosition().NewSet(env))
+				So(order.OrderLine().Tax().Equals(taxExclude), ShouldBeTrue)
+				So(order.ComputeTax().HasOrderLine(), ShouldBeFalse)
+			})
 			Convey("Test different price lists are correctly applied based on dates", func() {
 				uom := h.ProductUom().Search(env, q.ProductUom().Name().Equals("Unit(s)"))
 				supportProduct := h.ProductProduct().NewSet(env).GetRecord("product_product_product_2")
@@ -201,6 +264,24 @@ func TestOnChangeProduct(t *testing.T) {
 				orderLine.Write(orderLine.OnchangeDiscount())
 				So(orderLine.PriceSubtotal(), ShouldEqual, 81)
 				So(orderLine.Discount(), ShouldEqual, 19)
+
+				pb := orderLine.PriceBreakdown()
+				So(pb.BaseField, ShouldEqual, "LstPrice")
+				So(pb.BasePrice, ShouldEqual, 100)
+				So(pb.ListPrice, ShouldEqual, 100)
+				So(pb.Steps, ShouldHaveLength, 2)
+				So(pb.Steps[0].Pricelist, ShouldEqual, "Second pricelist")
+				So(pb.Steps[0].Price, ShouldEqual, 81)
+				So(pb.Steps[1].Pricelist, ShouldEqual, "First pricelist")
+				So(pb.Steps[1].Price, ShouldEqual, 90)
+				So(pb.PricelistPrice, ShouldEqual, 81)
+				So(pb.Discount, ShouldEqual, 19)
+				So(pb.PriceUnit, ShouldEqual, 100)
+
+				orderLine.LogPriceBreakdown()
+				logs := so.ChangeLogs().Filtered(func(r m.SaleOrderLogSet) bool { return r.Kind() == "price_breakdown" })
+				So(logs.Len(), ShouldEqual, 1)
+				So(logs.Message(), ShouldContainSubstring, "Second pricelist")
 			})
 			Convey("Test prices are correctly applied with a pricelist with an other currency", func() {
 				uom := h.ProductUom().Search(env, q.ProductUom().Name().Equals("Unit(s)"))
@@ -252,6 +333,173 @@ func TestOnChangeProduct(t *testing.T) {
 				orderLine.Write(orderLine.ProductUomChange())
 				So(orderLine.PriceUnit(), ShouldEqual, 1800)
 			})
+			Convey("Test prices are updated when the pricelist of a quotation is changed", func() {
+				uom := h.ProductUom().Search(env, q.ProductUom().Name().Equals("Unit(s)"))
+				computerCase := h.ProductProduct().NewSet(env).GetRecord("product_product_product_16")
+				computerCase.SetListPrice(100)
+				partner := h.Partner().Create(env, h.Partner().NewData().SetName("George"))
+				groupDiscount := h.Group().NewSet(env).Search(q.Group().GroupID().Equals(GroupDiscountPerSOLine.ID))
+				currentUser := h.User().NewSet(env).CurrentUser()
+				currentUser.SetGroups(currentUser.Groups().Union(groupDiscount))
+				currentUser.SyncMemberships()
+
+				firstPricelist := h.ProductPricelist().Create(env, h.ProductPricelist().NewData().
+					SetName("First pricelist").
+					SetDiscountPolicy("with_discount").
+					CreateItems(h.ProductPricelistItem().NewData().
+						SetComputePrice("percentage").
+						SetBase("ListPrice").
+						SetPercentPrice(10).
+						SetAppliedOn("3_global")))
+				secondPricelist := h.ProductPricelist().Create(env, h.ProductPricelist().NewData().
+					SetName("Second pricelist").
+					SetDiscountPolicy("without_discount").
+					CreateItems(h.ProductPricelistItem().NewData().
+						SetComputePrice("percentage").
+						SetBase("ListPrice").
+						SetPercentPrice(20).
+						SetAppliedOn("3_global")))
+
+				so := h.SaleOrder().Create(env, h.SaleOrder().NewData().
+					SetPartner(partner).
+					SetDateOrder(dates.ParseDateTime("2018-07-11 12:00:00")).
+					SetPricelist(firstPricelist))
+				orderLine := h.SaleOrderLine().Create(env, h.SaleOrderLine().NewData().
+					SetName("Dummy").
+					SetProductUomQty(1).
+					SetProductUom(uom).
+					SetOrder(so).
+					SetProduct(computerCase))
+				orderLine.Write(orderLine.ProductChange())
+				manualLine := h.SaleOrderLine().Create(env, h.SaleOrderLine().NewData().
+					SetName("Negotiated").
+					SetProductUomQty(1).
+					SetProductUom(uom).
+					SetOrder(so).
+					SetProduct(computerCase).
+					SetPriceUnit(95).
+					SetPriceManual(true))
+				So(orderLine.PriceUnit(), ShouldEqual, 90)
+				So(so.UpdatePrices().IsEmpty(), ShouldBeTrue)
+
+				so.SetPricelist(secondPricelist)
+				So(orderLine.PriceUnit(), ShouldEqual, 90)
+				changed := so.UpdatePrices()
+				So(changed.Equals(orderLine), ShouldBeTrue)
+				So(orderLine.PriceUnit(), ShouldEqual, 100)
+				So(orderLine.Discount(), ShouldEqual, 20)
+				So(orderLine.PriceSubtotal(), ShouldEqual, 80)
+				So(manualLine.PriceUnit(), ShouldEqual, 95)
+				So(manualLine.Discount(), ShouldEqual, 0)
+				logs := so.ChangeLogs().Filtered(func(r m.SaleOrderLogSet) bool {
+					return r.Kind() == "price" && r.OrderLine().Equals(orderLine)
+				})
+				So(logs.Len(), ShouldEqual, 1)
+				So(so.UpdatePrices().IsEmpty(), ShouldBeTrue)
+
+				so.ActionConfirm()
+				So(func() { so.UpdatePrices() }, ShouldPanic)
+			})
+			Convey("Test prices set by hand are flagged and kept", func() {
+				uom := h.ProductUom().Search(env, q.ProductUom().Name().Equals("Unit(s)"))
+				computerCase := h.ProductProduct().NewSet(env).GetRecord("product_product_product_16")
+				computerCase.SetListPrice(100)
+				partner := h.Partner().Create(env, h.Partner().NewData().SetName("George"))
+				pricelist := h.ProductPricelist().Create(env, h.ProductPricelist().NewData().
+					SetName("First pricelist").
+					SetDiscountPolicy("with_discount").
+					CreateItems(h.ProductPricelistItem().NewData().
+						SetComputePrice("percentage").
+						SetBase("ListPrice").
+						SetPercentPrice(10).
+						SetAppliedOn("3_global")))
+				so := h.SaleOrder().Create(env, h.SaleOrder().NewData().
+					SetPartner(partner).
+					SetDateOrder(dates.ParseDateTime("2018-07-11 12:00:00")).
+					SetPricelist(pricelist))
+				orderLine := h.SaleOrderLine().Create(env, h.SaleOrderLine().NewData().
+					SetName("Dummy").
+					SetProductUomQty(1).
+					SetProductUom(uom).
+					SetOrder(so).
+					SetProduct(computerCase))
+				orderLine.Write(orderLine.ProductChange())
+				So(orderLine.PriceUnit(), ShouldEqual, 90)
+				So(orderLine.PriceManual(), ShouldBeFalse)
+
+				orderLine.SetPriceUnit(85)
+				So(orderLine.PriceManual(), ShouldBeTrue)
+				logs := so.ChangeLogs().Filtered(func(r m.SaleOrderLogSet) bool { return r.Kind() == "price_manual" })
+				So(logs.Len(), ShouldEqual, 1)
+				So(orderLine.ProductUomChange().HasPriceUnit(), ShouldBeFalse)
+				So(so.UpdatePrices().IsEmpty(), ShouldBeTrue)
+				So(orderLine.PriceUnit(), ShouldEqual, 85)
+				manualLines := h.SaleOrderLine().Search(env, q.SaleOrderLine().
+					Order().Equals(so).
+					And().PriceManual().Equals(true))
+				So(manualLines.Equals(orderLine), ShouldBeTrue)
+
+				orderLine.SetPriceUnit(90)
+				So(orderLine.PriceManual(), ShouldBeFalse)
+
+				orderLine.SetPriceUnit(85)
+				So(orderLine.PriceManual(), ShouldBeTrue)
+				So(orderLine.ActionResetPrice(), ShouldBeTrue)
+				So(orderLine.PriceUnit(), ShouldEqual, 90)
+				So(orderLine.PriceManual(), ShouldBeFalse)
+			})
+			Convey("Test the price ladder of an order line", func() {
+				uom := h.ProductUom().Search(env, q.ProductUom().Name().Equals("Unit(s)"))
+				computerCase := h.ProductProduct().NewSet(env).GetRecord("product_product_product_16")
+				computerCase.SetListPrice(100)
+				partner := h.Partner().Create(env, h.Partner().NewData().SetName("George"))
+				groupDiscount := h.Group().NewSet(env).Search(q.Group().GroupID().Equals(GroupDiscountPerSOLine.ID))
+				currentUser := h.User().NewSet(env).CurrentUser()
+				currentUser.SetGroups(currentUser.Groups().Union(groupDiscount))
+				currentUser.SyncMemberships()
+				pricelist := h.ProductPricelist().Create(env, h.ProductPricelist().NewData().
+					SetName("Volume pricelist").
+					SetDiscountPolicy("without_discount").
+					CreateItems(h.ProductPricelistItem().NewData().
+						SetComputePrice("percentage").
+						SetBase("ListPrice").
+						SetPercentPrice(10).
+						SetMinQuantity(10).
+						SetAppliedOn("3_global")).
+					CreateItems(h.ProductPricelistItem().NewData().
+						SetComputePrice("percentage").
+						SetBase("ListPrice").
+						SetPercentPrice(20).
+						SetMinQuantity(50).
+						SetAppliedOn("3_global")))
+				so := h.SaleOrder().Create(env, h.SaleOrder().NewData().
+					SetPartner(partner).
+					SetDateOrder(dates.ParseDateTime("2018-07-11 12:00:00")).
+					SetPricelist(pricelist))
+				orderLine := h.SaleOrderLine().Create(env, h.SaleOrderLine().NewData().
+					SetName("Dummy").
+					SetProductUomQty(1).
+					SetProductUom(uom).
+					SetOrder(so).
+					SetProduct(computerCase))
+				orderLine.Write(orderLine.ProductChange())
+				orderLine.Write(h.SaleOrderLine().NewData().SetProductUomQty(20))
+
+				ladder := orderLine.PriceLadder()
+				So(ladder, ShouldHaveLength, 3)
+				So(ladder[0].MinQuantity, ShouldEqual, 1)
+				So(ladder[0].Price, ShouldEqual, 100)
+				So(ladder[0].Current, ShouldBeFalse)
+				So(ladder[1].MinQuantity, ShouldEqual, 10)
+				So(ladder[1].PriceUnit, ShouldEqual, 100)
+				So(ladder[1].Discount, ShouldEqual, 10)
+				So(ladder[1].Price, ShouldEqual, 90)
+				So(ladder[1].Current, ShouldBeTrue)
+				So(ladder[2].MinQuantity, ShouldEqual, 50)
+				So(ladder[2].Price, ShouldEqual, 80)
+				So(ladder[2].Current, ShouldBeFalse)
+				So(orderLine.PriceLadderText(), ShouldContainSubstring, "From 50")
+			})
 		}), ShouldBeNil)
 	})
 }
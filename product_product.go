@@ -4,6 +4,7 @@
 package sale
 
 import (
+	"github.com/hexya-addons/sale/saletypes"
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/pool/h"
 	"github.com/hexya-erp/pool/m"
@@ -24,4 +25,18 @@ func init() {
 			return h.ProductProduct().NewData().SetSalesCount(
 				h.SaleReport().NewSet(rs.Env()).Search(cond).SearchCount())
 		})
+
+	h.ProductProduct().Methods().GetSaleLineWarning().DeclareMethod(
+		`GetSaleLineWarning returns the warning to display when selling this product.`,
+		func(rs m.ProductProductSet) saletypes.SaleWarning {
+			if rs.IsEmpty() || rs.SaleLineWarn() == "no-message" {
+				return saletypes.SaleWarning{}
+			}
+			rs.EnsureOne()
+			return saletypes.SaleWarning{
+				Title:    rs.T("Warning for %s", rs.Name()),
+				Message:  rs.SaleLineWarnMsg(),
+				Blocking: rs.SaleLineWarn() == "block",
+			}
+		})
 }
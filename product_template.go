@@ -39,7 +39,9 @@ Create a task and track hours: Create a task on the sale order validation and tr
 			"delivery": "Delivered quantities",
 		}, Help: `Ordered Quantity: Invoice based on the quantity the customer ordered.
 Delivered Quantity: Invoiced based on the quantity the vendor delivered (time or deliveries).`,
-			Default: models.DefaultValue("order")},
+			Default: func(env models.Environment) interface{} {
+				return h.ConfigParameter().NewSet(env).Sudo().GetParam("sale.default_invoice_policy", "order")
+			}},
 	})
 
 	h.ProductTemplate().Methods().ComputeSalesCount().DeclareMethod(
@@ -0,0 +1,251 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/hexya-erp/hexya/src/actions"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/server"
+	"github.com/hexya-erp/hexya/src/templates"
+	"github.com/hexya-erp/hexya/src/tools/hweb"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+// ReportSaleOrderURL is the URL at which the sale order report is served.
+// Order ids must be appended as a comma separated list.
+const ReportSaleOrderURL = "/sale/report/saleorder/"
+
+// formatAmount returns the given amount formatted with the symbol
+// and decimal places of the given currency.
+func formatAmount(amount float64, currency m.CurrencySet) string {
+	if currency.IsEmpty() {
+		return strconv.FormatFloat(amount, 'f', 2, 64)
+	}
+	value := strconv.FormatFloat(currency.Round(amount), 'f', currency.DecimalPlaces(), 64)
+	if currency.Position() == "before" {
+		return fmt.Sprintf("%s %s", currency.Symbol(), value)
+	}
+	return fmt.Sprintf("%s %s", value, currency.Symbol())
+}
+
+// addressLines returns the name and the formatted address of the given partner
+// as a slice of non empty lines.
+func addressLines(partner m.PartnerSet) []string {
+	if partner.IsEmpty() {
+		return nil
+	}
+	res := []string{partner.Name()}
+	for _, line := range strings.Split(partner.DisplayAddress(true), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		res = append(res, strings.TrimSpace(line))
+	}
+	return res
+}
+
+// renderTemplate renders the template with the given ID in the given language.
+func renderTemplate(lang, id string, data hweb.Context) ([]byte, error) {
+	template, err := templates.Registry.FromCache(strings.TrimPrefix(path.Join(lang, id), "/"))
+	if err != nil {
+		return nil, err
+	}
+	return template.ExecuteBytes(data)
+}
+
+func init() {
+
+	h.SaleOrder().Methods().GetReportValues().DeclareMethod(
+		`GetReportValues returns the values used to render this order in the sale order report.`,
+		func(rs m.SaleOrderSet) map[string]interface{} {
+			rs.EnsureOne()
+			currency := rs.Pricelist().Currency()
+			isQuotation := rs.State() == "draft" || rs.State() == "sent"
+			title := rs.T("Order #")
+			if isQuotation {
+				title = rs.T("Quotation #")
+			}
+			var (
+				sections     []hweb.Context
+				showDiscount bool
+			)
+			showPriceTotal := h.User().NewSet(rs.Env()).CurrentUser().HasGroup(GroupShowPriceTotal.ID)
+			pages := rs.OrderLinesLayouted()
+			showSectionNames := len(pages) > 1 || len(pages[0]) > 1 ||
+				(len(pages[0]) == 1 && !pages[0][0].Default)
+			for _, page := range pages {
+				for _, layoutSection := range page {
+					var (
+						lines  []hweb.Context
+						amount float64
+					)
+					for _, line := range rs.LayoutSectionLines(layoutSection).Records() {
+						var taxes []string
+						for _, tax := range line.Tax().Records() {
+							if tax.Description() != "" {
+								taxes = append(taxes, tax.Description())
+								continue
+							}
+							taxes = append(taxes, tax.Name())
+						}
+						price := line.PriceSubtotal()
+						if showPriceTotal {
+							price = line.PriceTotal()
+						}
+						if line.Discount() != 0 {
+							showDiscount = true
+						}
+						lines = append(lines, hweb.Context{
+							"description": line.Name(),
+							"quantity":    strconv.FormatFloat(line.ProductUomQty(), 'f', -1, 64),
+							"uom":         line.ProductUom().Name(),
+							"price_unit":  strconv.FormatFloat(line.PriceUnit(), 'f', -1, 64),
+							"discount":    strconv.FormatFloat(line.Discount(), 'f', -1, 64),
+							"taxes":       strings.Join(taxes, ", "),
+							"price":       formatAmount(price, currency),
+						})
+						amount += price
+					}
+					var name string
+					if showSectionNames {
+						name = layoutSection.Name
+					}
+					sections = append(sections, hweb.Context{
+						"name":          name,
+						"show_subtotal": layoutSection.Subtotal,
+						"pagebreak":     layoutSection.Pagebreak,
+						"lines":         lines,
+						"subtotal":      formatAmount(amount, currency),
+					})
+				}
+			}
+			var optionalLines []hweb.Context
+			for _, line := range rs.OptionalLines().Records() {
+				price := line.PriceSubtotal()
+				if showPriceTotal {
+					price = line.PriceTotal()
+				}
+				if line.Discount() != 0 {
+					showDiscount = true
+				}
+				optionalLines = append(optionalLines, hweb.Context{
+					"description": line.Name(),
+					"quantity":    strconv.FormatFloat(line.ProductUomQty(), 'f', -1, 64),
+					"uom":         line.ProductUom().Name(),
+					"price_unit":  strconv.FormatFloat(line.PriceUnit(), 'f', -1, 64),
+					"discount":    strconv.FormatFloat(line.Discount(), 'f', -1, 64),
+					"price":       formatAmount(price, currency),
+				})
+			}
+			var taxGroups []hweb.Context
+			for _, taxGroup := range rs.GetTaxAmountByGroup() {
+				taxGroups = append(taxGroups, hweb.Context{
+					"name":   taxGroup.GroupName,
+					"amount": formatAmount(taxGroup.TaxAmount, currency),
+				})
+			}
+			var validityDate string
+			if !rs.ValidityDate().IsZero() {
+				validityDate = rs.ValidityDate().String()
+			}
+			showAddresses := !rs.PartnerShipping().Equals(rs.PartnerInvoice()) ||
+				!rs.PartnerInvoice().Equals(rs.Partner())
+			return hweb.Context{
+				"id":                rs.ID(),
+				"name":              rs.Name(),
+				"title":             title,
+				"is_quotation":      isQuotation,
+				"partner_address":   addressLines(rs.Partner()),
+				"partner_vat":       rs.Partner().VAT(),
+				"invoice_address":   addressLines(rs.PartnerInvoice()),
+				"shipping_address":  addressLines(rs.PartnerShipping()),
+				"show_addresses":    showAddresses,
+				"client_order_ref":  rs.ClientOrderRef(),
+				"date_order":        rs.DateOrder().ToDate().String(),
+				"validity_date":     validityDate,
+				"salesperson":       rs.User().Name(),
+				"payment_term":      rs.PaymentTerm().Name(),
+				"payment_term_note": rs.PaymentTerm().Note(),
+				"sections":          sections,
+				"optional_lines":    optionalLines,
+				"show_discount":     showDiscount,
+				"tax_groups":        taxGroups,
+				"amount_untaxed":    formatAmount(rs.AmountUntaxed(), currency),
+				"amount_tax":        formatAmount(rs.AmountTax(), currency),
+				"amount_total":      formatAmount(rs.AmountTotal(), currency),
+				"note":              rs.Note(),
+			}
+		})
+
+	h.SaleOrder().Methods().RenderHTML().DeclareMethod(
+		`RenderHTML renders the sale order report of all the orders of this RecordSet
+		and returns the resulting HTML document. The report is rendered in the language
+		of the context.`,
+		func(rs m.SaleOrderSet) []byte {
+			docs := make([]hweb.Context, rs.Len())
+			for i, order := range rs.Records() {
+				docs[i] = order.GetReportValues()
+			}
+			res, err := renderTemplate(rs.Env().Context().GetString("lang"), "sale.report_saleorder", hweb.Context{
+				"docs": docs,
+			})
+			if err != nil {
+				panic(rs.T("Unable to render the sale order report: %s", err))
+			}
+			return res
+		})
+
+	h.SaleOrder().Methods().GetReportAction().DeclareMethod(
+		`GetReportAction returns a client action that opens the sale order report
+		of the orders of this RecordSet.`,
+		func(rs m.SaleOrderSet) *actions.Action {
+			ids := make([]string, rs.Len())
+			for i, id := range rs.Ids() {
+				ids[i] = strconv.FormatInt(id, 10)
+			}
+			return &actions.Action{
+				Type: actions.ActionClient,
+				Tag:  "sale.report",
+				Name: rs.T("Quotation / Order"),
+				Context: types.NewContext().
+					WithKey("active_ids", rs.Ids()).
+					WithKey("report_url", ReportSaleOrderURL+strings.Join(ids, ",")),
+			}
+		})
+
+}
+
+// ReportSaleOrder is the controller that serves the HTML sale order report
+// of the orders given by their comma separated ids in the URL.
+func ReportSaleOrder(c *server.Context) {
+	var ids []int64
+	for _, idStr := range strings.Split(c.Param("ids"), ",") {
+		id, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			c.Error(fmt.Errorf("unable to read sale order ID: %s", err))
+			return
+		}
+		ids = append(ids, id)
+	}
+	uid := c.Session().Get("uid").(int64)
+	var res []byte
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		lang := h.User().Browse(env, []int64{uid}).ContextGet().GetString("lang")
+		orders := h.SaleOrder().Browse(env, ids)
+		res = orders.WithContext("lang", lang).RenderHTML()
+	})
+	if err != nil {
+		c.Error(fmt.Errorf("unable to render sale order report: %s", err))
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", res)
+}
@@ -29,6 +29,7 @@ func init() {
 		"User":              models.Many2OneField{String: "Salesperson", RelationModel: h.User() /* readonly=true */},
 		"PriceTotal":        models.FloatField{String: "Total" /*[ readonly True]*/},
 		"PriceSubtotal":     models.FloatField{String: "Untaxed Total" /*[ readonly True]*/},
+		"Margin":            models.FloatField{String: "Margin" /*[ readonly True]*/},
 		"ProductTmpl":       models.Many2OneField{String: "Product Template", RelationModel: h.ProductTemplate() /* readonly=true */},
 		"Category":          models.Many2OneField{String: "Product Category", RelationModel: h.ProductCategory() /* readonly=true */},
 		"Nbr":               models.IntegerField{String: "# of Lines" /*[ readonly True]*/},
@@ -37,12 +38,17 @@ func init() {
 		"Team":              models.Many2OneField{String: "Sales Team", RelationModel: h.CRMTeam() /* readonly=true */},
 		"Country":           models.Many2OneField{String: "Partner Country", RelationModel: h.Country() /* readonly=true */},
 		"CommercialPartner": models.Many2OneField{String: "Commercial Entity", RelationModel: h.Partner() /* readonly=true */},
+		"CancelReason":      models.Many2OneField{String: "Cancellation Reason", RelationModel: h.SaleCancelReason()},
+		"PriceManual":       models.BooleanField{String: "Manual Price"},
 		"State": models.SelectionField{String: "Status", Selection: types.Selection{
-			"draft":  "Draft Quotation",
-			"sent":   "Quotation Sent",
-			"sale":   "Sales Order",
-			"done":   "Sales Done",
-			"cancel": "Cancelled",
+			"draft":      "Draft Quotation",
+			"sent":       "Quotation Sent",
+			"sale":       "Sales Order",
+			"done":       "Sales Done",
+			"cancel":     "Cancelled",
+			"expired":    "Expired",
+			"to_approve": "To Approve",
+			"revised":    "Old Revision",
 		} /*[ readonly True]*/},
 		"Weight": models.FloatField{String: "Gross Weight" /*[ readonly True]*/},
 		"Volume": models.FloatField{ /*[ readonly True]*/ },
@@ -62,6 +68,7 @@ func init() {
 			              sum(l.qty_to_invoice / u.factor * u2.factor) as qty_to_invoice,
 			              sum(l.price_total / COALESCE(cr.rate, 1.0)) as price_total,
 			              sum(l.price_subtotal / COALESCE(cr.rate, 1.0)) as price_subtotal,
+			              sum(l.margin / COALESCE(cr.rate, 1.0)) as margin,
 			              count(*) as nbr,
 			              s.name as name,
 			              s.date_order as date,
@@ -74,6 +81,8 @@ func init() {
 			              s.pricelist_id as pricelist_id,
 			              s.project_id as analytic_account_id,
 			              s.team_id as team_id,
+			              s.cancel_reason_id as cancel_reason_id,
+			              l.price_manual as price_manual,
 			              p.product_tmpl_id,
 			              partner.country_id as country_id,
 			              partner.commercial_partner_id as commercial_partner_id,
@@ -103,6 +112,14 @@ func init() {
 			return fromStr
 		})
 
+	h.SaleReport().Methods().WhereClause().DeclareMethod(
+		`WhereClause returns the where clause of the SQL view. Old revisions of quotations are left out.`,
+		func(rs m.SaleReportSet) string {
+			return `
+				WHERE s.state <> 'revised'
+			`
+		})
+
 	h.SaleReport().Methods().GroupByClause().DeclareMethod(
 		`GroupByClause returns the group by clause of the SQL view`,
 		func(rs m.SaleReportSet) string {
@@ -120,6 +137,8 @@ func init() {
 					s.pricelist_id,
 					s.project_id,
 					s.team_id,
+					s.cancel_reason_id,
+					l.price_manual,
 					p.product_tmpl_id,
 					partner.country_id,
 					partner.commercial_partner_id
@@ -136,7 +155,8 @@ func init() {
 					%s
 				FROM ( %s )
 					%s
-				)`, rs.Select(), rs.From(), rs.GroupByClause()))
+					%s
+				)`, rs.Select(), rs.From(), rs.WhereClause(), rs.GroupByClause()))
 		})
 
 }
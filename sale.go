@@ -12,6 +12,8 @@ import (
 
 	"github.com/hexya-addons/account/accounttypes"
 	"github.com/hexya-addons/decimalPrecision"
+	"github.com/hexya-addons/sale/saletypes"
+	"github.com/hexya-addons/saleTeams"
 	"github.com/hexya-erp/hexya/src/actions"
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/types"
@@ -24,6 +26,56 @@ import (
 	"github.com/hexya-erp/pool/q"
 )
 
+// readOnlyUnlessQuotation makes a SaleOrder field read only once the order is no longer a quotation.
+func readOnlyUnlessQuotation(env models.Environment) (bool, models.Conditioner) {
+	return false, q.SaleOrder().State().NotIn([]string{"draft", "sent"})
+}
+
+// readOnlyIfLocked makes a SaleOrder field read only when the order is locked, cancelled or an old revision.
+func readOnlyIfLocked(env models.Environment) (bool, models.Conditioner) {
+	return false, q.SaleOrder().State().In([]string{"done", "cancel", "revised"})
+}
+
+// realPriceBase returns the product field on which the price of the given product is based
+// before the given pricelist rule is applied, the product to read this field on, the currency of
+// the rule and the currency of the field.
+//
+// Rules of pricelists that do not show discounts are followed down to the first rule based on
+// the public price, the cost or a pricelist that shows discounts.
+func realPriceBase(rs m.SaleOrderLineSet, product m.ProductProductSet, rule m.ProductPricelistItemSet, qty float64,
+	uom m.ProductUomSet) (string, m.ProductProductSet, m.CurrencySet, m.CurrencySet) {
+	fieldName := "LstPrice"
+	currency := h.Currency().NewSet(rs.Env())
+	productCurrency := h.Currency().NewSet(rs.Env())
+	if rule.IsNotEmpty() {
+		pricelistItem := rule
+		if pricelistItem.Pricelist().DiscountPolicy() == "without_discount" {
+			for pricelistItem.Base() == "pricelist" && pricelistItem.BasePricelist().IsNotEmpty() &&
+				pricelistItem.BasePricelist().DiscountPolicy() == "without_discount" {
+				pricelistItem = pricelistItem.BasePricelist().GetProductPriceRule(product, qty, rs.Order().Partner(), dates.Date{}, uom)
+			}
+		}
+		if pricelistItem.Base() == "StandardPrice" {
+			fieldName = "StandardPrice"
+		}
+		if pricelistItem.Base() == "pricelist" && !pricelistItem.BasePricelist().IsEmpty() {
+			fieldName = "Price"
+			product = product.WithContext("pricelist", pricelistItem.BasePricelist().ID())
+			productCurrency = pricelistItem.BasePricelist().Currency()
+		}
+		currency = pricelistItem.Pricelist().Currency()
+	}
+
+	switch {
+	case productCurrency.IsNotEmpty():
+	case product.Company().IsNotEmpty():
+		productCurrency = product.Company().Currency()
+	default:
+		productCurrency = h.User().NewSet(rs.Env()).CurrentUser().Company().Currency()
+	}
+	return fieldName, product, currency, productCurrency
+}
+
 func init() {
 
 	h.SaleOrder().DeclareModel()
@@ -41,64 +93,57 @@ func init() {
 			Help: "Reference of the document that generated this sales order request."},
 		"ClientOrderRef": models.CharField{String: "Customer Reference", NoCopy: true},
 		"State": models.SelectionField{String: "Status", Selection: types.Selection{
-			"draft":  "Quotation",
-			"sent":   "Quotation Sent",
-			"sale":   "Sales Order",
-			"done":   "Locked",
-			"cancel": "Cancelled",
+			"draft":      "Quotation",
+			"sent":       "Quotation Sent",
+			"sale":       "Sales Order",
+			"done":       "Locked",
+			"cancel":     "Cancelled",
+			"expired":    "Expired",
+			"to_approve": "To Approve",
+			"revised":    "Old Revision",
 		}, ReadOnly: true, NoCopy: true, Index: true, /*[ track_visibility 'onchange']*/
 			Default: models.DefaultValue("draft")},
-		"DateOrder": models.DateTimeField{String: "Order Date", Required: true, Index: true, /*[ readonly True]*/
-			/*[ states {'draft': [('readonly']*/ /*[ False)]]*/
-			/*[ 'sent': [('readonly'] [ False)]}]*/
-			NoCopy: true, Default: func(env models.Environment) interface{} {
+		"DateOrder": models.DateTimeField{String: "Order Date", Required: true, Index: true,
+			ReadOnlyFunc: readOnlyUnlessQuotation, NoCopy: true, Default: func(env models.Environment) interface{} {
 				return dates.Now()
 			}},
-		"ValidityDate": models.DateField{String: "Expiration Date" /*[ readonly True]*/, NoCopy: true,
-			/*[ states {'draft': [('readonly']*/ /*[ False)]]*/
-			/*[ 'sent': [('readonly'] [ False)]}]*/
+		"ValidityDate": models.DateField{String: "Expiration Date", NoCopy: true,
+			ReadOnlyFunc: readOnlyUnlessQuotation,
+			Default: func(env models.Environment) interface{} {
+				days := h.User().NewSet(env).CurrentUser().Company().QuotationValidityDays()
+				if days <= 0 {
+					return dates.Date{}
+				}
+				return dates.Today().AddDate(0, 0, days)
+			},
 			Help: `Manually set the expiration date of your quotation (offer), or it will set the date automatically
-based on the template if online quotation is installed.`},
+based on the default validity of quotations of the company.`},
 		"ConfirmationDate": models.DateTimeField{Index: true, ReadOnly: true,
 			Help: "Date on which the sale order is confirmed."},
 		"User": models.Many2OneField{String: "Salesperson", RelationModel: h.User(), Index: true, /*[ track_visibility 'onchange']*/
 			Default: func(env models.Environment) interface{} {
 				return h.User().NewSet(env).CurrentUser()
 			}},
-		"Partner": models.Many2OneField{String: "Customer", RelationModel: h.Partner(), /* readonly=true */
-			/*[ states {'draft': [('readonly'] [ False)]]*/
-			/*[ 'sent': [('readonly'] [ False)]}]*/
+		"Partner": models.Many2OneField{String: "Customer", RelationModel: h.Partner(), ReadOnlyFunc: readOnlyUnlessQuotation,
 			OnChange: h.SaleOrder().Methods().OnchangePartner(),
 			Required: true, Index: true /*[ track_visibility 'always']*/},
-		"PartnerInvoice": models.Many2OneField{String: "Invoice Address", RelationModel: h.Partner(), /* readonly=true */
-			Required: true,
-			/*[ states {'draft': [('readonly']*/ /*[ False)]]*/
-			/*[ 'sent': [('readonly'] [ False)]}]*/
+		"PartnerInvoice": models.Many2OneField{String: "Invoice Address", RelationModel: h.Partner(),
+			Required: true, ReadOnlyFunc: readOnlyUnlessQuotation,
 			Help: "Invoice address for current sales order."},
-		"PartnerShipping": models.Many2OneField{String: "Delivery Address", RelationModel: h.Partner(), /* readonly=true */
-			Required: true,
-			/*[ states {'draft': [('readonly']*/ /*[ False)]]*/
-			/*[ 'sent': [('readonly'] [ False)]}]*/
+		"PartnerShipping": models.Many2OneField{String: "Delivery Address", RelationModel: h.Partner(),
+			Required: true, ReadOnlyFunc: readOnlyUnlessQuotation,
 			OnChange: h.SaleOrder().Methods().OnchangePartnerShipping(),
 			Help:     "Delivery address for current sales order."},
-		"Pricelist": models.Many2OneField{RelationModel: h.ProductPricelist(), Required: true, /* readonly=true */
-			/*[ states {'draft': [('readonly']*/ /*[ False)]]*/
-			/*[ 'sent': [('readonly'] [ False)]}]*/
-			Help: "Pricelist for current sales order."},
+		"Pricelist": models.Many2OneField{RelationModel: h.ProductPricelist(), Required: true,
+			ReadOnlyFunc: readOnlyUnlessQuotation, Help: "Pricelist for current sales order."},
 		"Currency": models.Many2OneField{RelationModel: h.Currency(),
 			Related: "Pricelist.Currency", ReadOnly: true, Required: true},
 		"Project": models.Many2OneField{String: "Analytic Account", RelationModel: h.AccountAnalyticAccount(),
-			/* readonly=true */
-			/*[ states {'draft': [('readonly'] [ False)]]*/
-			/*[ 'sent': [('readonly'] [ False)]}]*/
-			Help: "The analytic account related to a sales order.", NoCopy: true},
+			ReadOnlyFunc: readOnlyUnlessQuotation, Help: "The analytic account related to a sales order.", NoCopy: true},
 		"RelatedProject": models.Many2OneField{String: "Analytic Account", RelationModel: h.AccountAnalyticAccount(),
 			Related: "Project", Help: "The analytic account related to a sales order."},
 		"OrderLine": models.One2ManyField{String: "Order Lines", RelationModel: h.SaleOrderLine(),
-			ReverseFK: "Order",
-			/*[ states {'cancel': [('readonly'] [ True)]]*/
-			/*[ 'done': [('readonly'] [ True)]}]*/
-			Copy: true},
+			ReverseFK: "Order", ReadOnlyFunc: readOnlyIfLocked, Copy: true},
 		"InvoiceCount": models.IntegerField{String: "# of Invoices",
 			Compute: h.SaleOrder().Methods().GetInvoiced(),
 			Depends: []string{"State", "OrderLine.InvoiceStatus"}, GoType: new(int)},
@@ -112,19 +157,25 @@ based on the template if online quotation is installed.`},
 			"no":         "Nothing to Invoice",
 		}, Compute: h.SaleOrder().Methods().GetInvoiced(),
 			Depends: []string{"State", "OrderLine.InvoiceStatus"}, Stored: true},
+		"PaymentStatus": models.SelectionField{Selection: types.Selection{
+			"not_paid": "Not Paid",
+			"partial":  "Partially Paid",
+			"paid":     "Paid",
+		}, Compute: h.SaleOrder().Methods().ComputePaymentStatus(),
+			Help: "Payment status of the validated customer invoices of this order."},
 		"Note": models.TextField{String: "Terms and conditions",
 			Default: func(env models.Environment) interface{} {
 				return h.User().NewSet(env).CurrentUser().Company().SaleNote()
 			}},
 		"AmountUntaxed": models.FloatField{String: "Untaxed Amount", Stored: true,
 			Compute: h.SaleOrder().Methods().AmountAll(), /*[ track_visibility 'always']*/
-			Depends: []string{"OrderLine.PriceTotal"}},
+			Depends: []string{"OrderLine.PriceTotal", "OrderLine.IsOptional"}},
 		"AmountTax": models.FloatField{String: "Taxes", Stored: true,
 			Compute: h.SaleOrder().Methods().AmountAll(), /*[ track_visibility 'always']*/
-			Depends: []string{"OrderLine.PriceTotal"}},
+			Depends: []string{"OrderLine.PriceTotal", "OrderLine.IsOptional"}},
 		"AmountTotal": models.FloatField{String: "Total", Stored: true,
 			Compute: h.SaleOrder().Methods().AmountAll(), /*[ track_visibility 'always']*/
-			Depends: []string{"OrderLine.PriceTotal"}},
+			Depends: []string{"OrderLine.PriceTotal", "OrderLine.IsOptional"}},
 		"PaymentTerm": models.Many2OneField{String: "Payment Terms", RelationModel: h.AccountPaymentTerm()},
 		"FiscalPosition": models.Many2OneField{RelationModel: h.AccountFiscalPosition(),
 			OnChange: h.SaleOrder().Methods().ComputeTax()},
@@ -138,13 +189,19 @@ based on the template if online quotation is installed.`},
 			}},
 		"ProcurementGroup": models.Many2OneField{RelationModel: h.ProcurementGroup(), NoCopy: true},
 		"Product":          models.Many2OneField{RelationModel: h.ProductProduct(), Related: "OrderLine.Product"},
+		"PartnerWarning": models.TextField{String: "Customer Warning",
+			Compute: h.SaleOrder().Methods().ComputePartnerWarning(), Depends: []string{"Partner"}},
 	})
 
 	h.SaleOrder().Methods().AmountAll().DeclareMethod(
-		`AmountAll computes all the amounts of this sale order by summing its sale order lines.`,
+		`AmountAll computes all the amounts of this sale order by summing its sale order lines.
+		Optional lines are not included.`,
 		func(rs m.SaleOrderSet) m.SaleOrderData {
 			var amountUntaxed, amountTaxed float64
 			for _, line := range rs.OrderLine().Records() {
+				if line.IsOptional() {
+					continue
+				}
 				amountUntaxed += line.PriceSubtotal()
 				if rs.Company().TaxCalculationRoundingMethod() == "round_globally" {
 					price := line.PriceUnit() * (1 - line.Discount()/100)
@@ -232,19 +289,81 @@ based on the template if online quotation is installed.`},
 				SetInvoiceStatus(invoiceStatus)
 		})
 
+	h.SaleOrder().Methods().ComputePaymentStatus().DeclareMethod(
+		`ComputePaymentStatus computes the payment status of this order from the amount
+		remaining due on its validated customer invoices, net of its validated refunds.
+		An order whose invoices are fully refunded is not paid.`,
+		func(rs m.SaleOrderSet) m.SaleOrderData {
+			var total, residual float64
+			for _, invoice := range rs.Invoices().Records() {
+				if invoice.State() != "open" && invoice.State() != "paid" {
+					continue
+				}
+				switch invoice.Type() {
+				case "out_invoice":
+					total += invoice.AmountTotal()
+					residual += invoice.Residual()
+				case "out_refund":
+					total -= invoice.AmountTotal()
+					residual -= invoice.Residual()
+				}
+			}
+			currency := rs.Pricelist().Currency()
+			status := "not_paid"
+			switch {
+			case currency.CompareAmounts(total, 0) <= 0:
+				// Nothing is left to pay once the refunds are deducted
+			case currency.CompareAmounts(residual, 0) <= 0:
+				status = "paid"
+			case currency.CompareAmounts(residual, total) < 0:
+				status = "partial"
+			}
+			return h.SaleOrder().NewData().SetPaymentStatus(status)
+		})
+
 	h.SaleOrder().Methods().ComputeTax().DeclareMethod(
-		`ComputeTax triggers the recompute of the taxes if the fiscal position is changed on the SO.`,
+		`ComputeTax triggers the recompute of the taxes if the fiscal position is changed on the SO.
+		It returns the lines with their new taxes and the new amounts of the order.
+		The taxes of confirmed orders are kept.`,
 		func(rs m.SaleOrderSet) m.SaleOrderData {
-			//@api.onchange('fiscal_position_id')
-			/*def _compute_tax_id(self):
-			  """
-			  Trigger the recompute of the taxes if the fiscal position is changed on the SO.
-			  """
-			  for order in self:
-			      order.order_line._compute_tax_id()
-			*/
-			// TODO : need to implement onchange on relation fields first
-			return h.SaleOrder().NewData()
+			if rs.State() != "draft" && rs.State() != "sent" {
+				return h.SaleOrder().NewData()
+			}
+			rs.OrderLine().RecomputeTax()
+			return rs.AmountAll().SetOrderLine(rs.OrderLine())
+		})
+
+	h.SaleOrder().Methods().ActionRecomputeTaxes().DeclareMethod(
+		`ActionRecomputeTaxes recomputes the taxes of all the lines of the quotations of this
+		RecordSet from their product and the fiscal position of the order.`,
+		func(rs m.SaleOrderSet) bool {
+			for _, order := range rs.Records() {
+				if order.State() != "draft" && order.State() != "sent" {
+					panic(rs.T("Taxes can only be recomputed on quotations, but %s is not a quotation.", order.Name()))
+				}
+			}
+			for _, order := range rs.Records() {
+				order.OrderLine().RecomputeTax()
+			}
+			return true
+		})
+
+	h.SaleOrder().Methods().Write().Extend("",
+		func(rs m.SaleOrderSet, data m.SaleOrderData) bool {
+			if data.HasPartner() {
+				rs.CheckPartnerWarning(data.Partner())
+			}
+			if !data.HasFiscalPosition() {
+				return rs.Super().Write(data)
+			}
+			changed := rs.Filtered(func(r m.SaleOrderSet) bool {
+				return (r.State() == "draft" || r.State() == "sent") && !r.FiscalPosition().Equals(data.FiscalPosition())
+			})
+			res := rs.Super().Write(data)
+			for _, order := range changed.Records() {
+				order.OrderLine().RecomputeTax()
+			}
+			return res
 		})
 
 	h.SaleOrder().Methods().GetCustomerLead().DeclareMethod(
@@ -269,26 +388,17 @@ based on the template if online quotation is installed.`},
 			return rs.Super().Unlink()
 		})
 
-	//h.SaleOrder().Methods().TrackSubtype().DeclareMethod(
-	//	`TrackSubtype`,
-	//	func(rs m.SaleOrderSet, initvalues interface{}) {
-	//		//@api.multi
-	//		/*def _track_subtype(self, init_values):
-	//		  self.ensure_one()
-	//		  if 'state' in init_values and self.state == 'sale':
-	//		      return 'sale.mt_order_confirmed'
-	//		  elif 'state' in init_values and self.state == 'sent':
-	//		      return 'sale.mt_order_sent'
-	//		  return super(SaleOrder, self)._track_subtype(init_values)
-	//
-	//		*/
-	//	})
-
 	h.SaleOrder().Methods().OnchangePartnerShipping().DeclareMethod(
-		`OnchangePartnerShipping triggers the change of fiscal position when the shipping address is modified.`,
+		`OnchangePartnerShipping triggers the change of fiscal position when the shipping address is modified.
+		The taxes of the lines are recomputed if the fiscal position changes.`,
 		func(rs m.SaleOrderSet) m.SaleOrderData {
-			return h.SaleOrder().NewData().SetFiscalPosition(
-				h.AccountFiscalPosition().NewSet(rs.Env()).GetFiscalPosition(rs.Partner(), rs.PartnerShipping()))
+			fPos := h.AccountFiscalPosition().NewSet(rs.Env()).GetFiscalPosition(rs.Partner(), rs.PartnerShipping())
+			data := h.SaleOrder().NewData().SetFiscalPosition(fPos)
+			if !fPos.Equals(rs.FiscalPosition()) {
+				rs.SetFiscalPosition(fPos)
+				data.MergeWith(rs.AmountAll())
+			}
+			return data
 		})
 
 	h.SaleOrder().Methods().OnchangePartner().DeclareMethod(
@@ -297,6 +407,8 @@ based on the template if online quotation is installed.`},
 		- Payment term
 		- Invoice address
 		- Delivery address
+
+		If the partner is blocked for sales, the partner and its addresses are cleared instead.
 		`,
 		func(rs m.SaleOrderSet) m.SaleOrderData {
 			if rs.Partner().IsEmpty() {
@@ -306,6 +418,14 @@ based on the template if online quotation is installed.`},
 					SetPaymentTerm(h.AccountPaymentTerm().NewSet(rs.Env())).
 					SetFiscalPosition(h.AccountFiscalPosition().NewSet(rs.Env()))
 			}
+			if rs.Partner().GetSaleWarning().Blocking {
+				// Blocked customers cannot be selected
+				return h.SaleOrder().NewData().
+					SetPartner(h.Partner().NewSet(rs.Env())).
+					SetPartnerInvoice(h.Partner().NewSet(rs.Env())).
+					SetPartnerShipping(h.Partner().NewSet(rs.Env())).
+					SetPricelist(h.ProductPricelist().NewSet(rs.Env()))
+			}
 			addr := rs.Partner().AddressGet([]string{"delivery", "invoice"})
 			values := h.SaleOrder().NewData().
 				SetPricelist(rs.Partner().PropertyProductPricelist()).
@@ -325,45 +445,28 @@ based on the template if online quotation is installed.`},
 			return values
 		})
 
-	//h.SaleOrder().Methods().OnchangePartnerWarning().DeclareMethod(
-	//	`OnchangePartnerWarning`,
-	//	func(rs m.SaleOrderSet) {
-	//		//@api.onchange('partner_id')
-	//		/*def onchange_partner_id_warning(self):
-	//		  if not self.partner_id:
-	//		      return
-	//		  warning = {}
-	//		  title = False
-	//		  message = False
-	//		  partner = self.partner_id
-	//
-	//		  # If partner has no warning, check its company
-	//		  if partner.sale_warn == 'no-message' and partner.parent_id:
-	//		      partner = partner.parent_id
-	//
-	//		  if partner.sale_warn != 'no-message':
-	//		      # Block if partner only has warning but parent company is blocked
-	//		      if partner.sale_warn != 'block' and partner.parent_id and partner.parent_id.sale_warn == 'block':
-	//		          partner = partner.parent_id
-	//		      title = ("Warning for %s") % partner.name
-	//		      message = partner.sale_warn_msg
-	//		      warning = {
-	//		              'title': title,
-	//		              'message': message,
-	//		      }
-	//		      if partner.sale_warn == 'block':
-	//		          self.update({'partner_id': False, 'partner_invoice_id': False, 'partner_shipping_id': False, 'pricelist_id': False})
-	//		          return {'warning': warning}
-	//
-	//		  if warning:
-	//		      return {'warning': warning}
-	//
-	//		*/
-	// TODO : need to implement onchange warnings first
-	//	})
+	h.SaleOrder().Methods().ComputePartnerWarning().DeclareMethod(
+		`ComputePartnerWarning computes the warning message to display for the customer of this order.`,
+		func(rs m.SaleOrderSet) m.SaleOrderData {
+			warning := rs.Partner().GetSaleWarning()
+			if warning.IsEmpty() {
+				return h.SaleOrder().NewData().SetPartnerWarning("")
+			}
+			return h.SaleOrder().NewData().SetPartnerWarning(fmt.Sprintf("%s\n%s", warning.Title, warning.Message))
+		})
+
+	h.SaleOrder().Methods().CheckPartnerWarning().DeclareMethod(
+		`CheckPartnerWarning panics if the given customer is blocked for sales.`,
+		func(rs m.SaleOrderSet, partner m.PartnerSet) {
+			warning := partner.GetSaleWarning()
+			if warning.Blocking {
+				panic(rs.T("%s\n%s", warning.Title, warning.Message))
+			}
+		})
 
 	h.SaleOrder().Methods().Create().Extend("",
 		func(rs m.SaleOrderSet, data m.SaleOrderData) m.SaleOrderSet {
+			rs.CheckPartnerWarning(data.Partner())
 			if data.Name() == "" || data.Name() == rs.T("New") {
 				seq := h.Sequence().NewSet(rs.Env())
 				if data.Company().IsNotEmpty() {
@@ -424,17 +527,8 @@ based on the template if online quotation is installed.`},
 	h.SaleOrder().Methods().PrintQuotation().DeclareMethod(
 		`PrintQuotation returns the action to print the quotation report`,
 		func(rs m.SaleOrderSet) *actions.Action {
-			//@api.multi
-			/*def print_quotation(self):
-			  self.filtered(lambda s: s.state == 'draft').write({'state': 'sent'})
-			  return self.env['report'].get_action(self, 'sale.report_saleorder')
-
-			*/
-			// TODO Implement reports first
 			rs.Search(q.SaleOrder().State().Equals("draft")).SetState("sent")
-			return &actions.Action{
-				Type: actions.ActionCloseWindow,
-			}
+			return rs.GetReportAction()
 		})
 
 	h.SaleOrder().Methods().ActionViewInvoice().DeclareMethod(
@@ -566,14 +660,15 @@ based on the template if online quotation is installed.`},
 		func(rs m.SaleOrderSet) bool {
 			orders := h.SaleOrder().NewSet(rs.Env())
 			for _, order := range rs.Records() {
-				if order.State() != "cancel" && order.State() != "sent" {
+				if order.State() != "cancel" && order.State() != "sent" && order.State() != "expired" {
 					continue
 				}
 				orders = orders.Union(order)
 			}
 			orders.Write(h.SaleOrder().NewData().
 				SetState("draft").
-				SetProcurementGroup(h.ProcurementGroup().NewSet(rs.Env())))
+				SetProcurementGroup(h.ProcurementGroup().NewSet(rs.Env())).
+				SetCancelReason(h.SaleCancelReason().NewSet(rs.Env())))
 			for _, order := range orders.Records() {
 				for _, line := range order.OrderLine().Records() {
 					for _, proc := range line.Procurements().Records() {
@@ -585,76 +680,53 @@ based on the template if online quotation is installed.`},
 		})
 
 	h.SaleOrder().Methods().ActionCancel().DeclareMethod(
-		`ActionCancel cancels this sale order.`,
+		`ActionCancel cancels this sale order.
+
+		The orders must have a cancellation reason and no validated invoices that have not been refunded.
+		Their draft invoices and their procurements are cancelled too.`,
 		func(rs m.SaleOrderSet) bool {
-			rs.SetState("cancel")
+			rs.CheckCancellation()
+			rs.CancelDraftInvoices()
+			for _, order := range rs.Records() {
+				order.OrderLine().CancelProcurements()
+				order.Write(h.SaleOrder().NewData().
+					SetState("cancel").
+					SetCancelReason(order.CancellationReason()))
+			}
 			return true
 		})
 
 	h.SaleOrder().Methods().ActionQuotationSend().DeclareMethod(
 		`ActionQuotationSend opens a window to compose an email,
-		with the edi sale template message loaded by default`,
+		with the edi sale template message loaded by default.
+		The mail is a draft until the Send button of the window is pressed.`,
 		func(rs m.SaleOrderSet) *actions.Action {
 			rs.EnsureOne()
-			//		//@api.multi
-			//		/*def action_quotation_send(self):
-			//		  '''
-			//		  This function opens a window to compose an email, with the edi sale template message loaded by default
-			//		  '''
-			//		  self.ensure_one()
-			//		  ir_model_data = self.env['ir.model.data']
-			//		  try:
-			//		      template_id = ir_model_data.get_object_reference('sale', 'email_template_edi_sale')[1]
-			//		  except ValueError:
-			//		      template_id = False
-			//		  try:
-			//		      compose_form_id = ir_model_data.get_object_reference('mail', 'email_compose_message_wizard_form')[1]
-			//		  except ValueError:
-			//		      compose_form_id = False
-			//		  ctx = dict()
-			//		  ctx.update({
-			//		      'default_model': 'sale.order',
-			//		      'default_res_id': self.ids[0],
-			//		      'default_use_template': bool(template_id),
-			//		      'default_template_id': template_id,
-			//		      'default_composition_mode': 'comment',
-			//		      'mark_so_as_sent': True,
-			//		      'custom_layout': "sale.mail_template_data_notification_email_sale_order"
-			//		  })
-			//		  return {
-			//		      'type': 'ir.actions.act_window',
-			//		      'view_type': 'form',
-			//		      'view_mode': 'form',
-			//		      'res_model': 'mail.compose.message',
-			//		      'views': [(compose_form_id, 'form')],
-			//		      'view_id': compose_form_id,
-			//		      'target': 'new',
-			//		      'context': ctx,
-			//		  }
-			//
-			//		*/
-			// FIXME: Next line for demo only
-			rs.Search(q.SaleOrder().State().Equals("draft")).SetState("sent")
+			saleMail := h.SaleMail().Create(rs.Env(), rs.PrepareQuotationMail().SetState("draft"))
 			return &actions.Action{
-				Type: actions.ActionCloseWindow,
+				Type:   actions.ActionActWindow,
+				Name:   rs.T("Send by Email"),
+				Model:  "SaleMail",
+				ResID:  saleMail.ID(),
+				View:   views.MakeViewRef("sale_view_sale_mail_compose"),
+				Views:  []views.ViewTuple{{ID: "sale_view_sale_mail_compose", Type: views.ViewTypeForm}},
+				Target: "new",
 			}
 		})
 
 	h.SaleOrder().Methods().ForceQuotationSend().DeclareMethod(
-		`ForceQuotationSend`,
+		`ForceQuotationSend sends the quotation e-mail of each order of this RecordSet
+		without opening the compose window. Orders whose customer has no e-mail address
+		are skipped.`,
 		func(rs m.SaleOrderSet) bool {
-			//@api.multi
-			/*def force_quotation_send(self):
-			  for order in self:
-			      email_act = order.action_quotation_send()
-			      if email_act and email_act.get('context'):
-			          email_ctx = email_act['context']
-			          email_ctx.update(default_email_from=order.company_id.email)
-			          order.with_context(email_ctx).message_post_with_template(email_ctx.get('default_template_id'))
-			  return True
-
-			*/
-			rs.ActionQuotationSend()
+			for _, order := range rs.Records() {
+				if order.Partner().Email() == "" {
+					log.Warn("Quotation e-mail not sent: customer has no e-mail address",
+						"order", order.Name(), "partner", order.Partner().Name())
+					continue
+				}
+				h.SaleMail().Create(rs.Env(), order.PrepareQuotationMail()).Send()
+			}
 			return true
 		})
 
@@ -665,6 +737,22 @@ based on the template if online quotation is installed.`},
 			return true
 		})
 
+	h.SaleOrder().Methods().ActionUnlock().DeclareMethod(
+		`ActionUnlock sets the locked orders of this RecordSet back to the sale state.
+		Only sales managers can unlock orders.`,
+		func(rs m.SaleOrderSet) bool {
+			user := h.User().NewSet(rs.Env()).CurrentUser()
+			if !user.HasGroup(saleTeams.GroupSaleManager.ID) {
+				panic(rs.T("Only a sales manager can unlock orders."))
+			}
+			orders := rs.Filtered(func(r m.SaleOrderSet) bool { return r.State() == "done" })
+			if orders.IsEmpty() {
+				return false
+			}
+			orders.SetState("sale")
+			return true
+		})
+
 	h.SaleOrder().Methods().PrepareProcurementGroup().DeclareMethod(
 		`PrepareProcurementGroup returns the data that will be used to create the
 		procurement group of this sale order`,
@@ -673,20 +761,32 @@ based on the template if online quotation is installed.`},
 		})
 
 	h.SaleOrder().Methods().ActionConfirm().DeclareMethod(
-		`ActionConfirm confirms this quotation into a sale order`,
+		`ActionConfirm confirms this quotation into a sale order.
+		Quotations that need an approval are sent for approval instead.`,
 		func(rs m.SaleOrderSet) bool {
+			confirmed := h.SaleOrder().NewSet(rs.Env())
 			for _, order := range rs.Records() {
+				order.CheckValidity()
+				order.CheckPartnerWarning(order.Partner())
+				order.CheckCreditLimit()
+				for _, line := range order.OrderLine().Records() {
+					line.CheckProductWarning(line.Product())
+				}
+				if !order.CheckApproval() {
+					continue
+				}
+				confirmed = confirmed.Union(order)
 				order.Write(h.SaleOrder().NewData().
 					SetState("sale").
 					SetConfirmationDate(dates.Now()))
 				if rs.Env().Context().HasKey("send_email") {
-					rs.ForceQuotationSend()
+					order.ForceQuotationSend()
 				}
 				order.OrderLine().ActionProcurementCreate()
 			}
 			autoDone := h.ConfigParameter().Search(rs.Env(), q.ConfigParameter().Key().Equals("sale.auto_done_setting"))
-			if autoDone.Value() != "" {
-				rs.ActionDone()
+			if autoDone.Value() != "" && confirmed.IsNotEmpty() {
+				confirmed.ActionDone()
 			}
 			return true
 		})
@@ -711,27 +811,42 @@ based on the template if online quotation is installed.`},
 	h.SaleOrder().Methods().OrderLinesLayouted().DeclareMethod(
 		`OrderLinesLayouted returns this order lines classified by sale_layout_category and separated in
         pages according to the category pagebreaks. Used to render the report.`,
-		func(rs m.SaleOrderSet) {
-			/*
-			   @api.multi
-			   def order_lines_layouted(self):
-			       self.ensure_one()
-			       report_pages = [[]]
-			       for category, lines in groupby(self.order_line, lambda l: l.layout_category_id):
-			           # If last added category induced a pagebreak, this one will be on a new page
-			           if report_pages[-1] and report_pages[-1][-1]['pagebreak']:
-			               report_pages.append([])
-			           # Append category to current report page
-			           report_pages[-1].append({
-			               'name': category and category.name or 'Uncategorized',
-			               'subtotal': category and category.subtotal,
-			               'pagebreak': category and category.pagebreak,
-			               'lines': list(lines)
-			           })
-
-			       return report_pages
-
-			*/
+		func(rs m.SaleOrderSet) []saletypes.LayoutPage {
+			rs.EnsureOne()
+			pages := []saletypes.LayoutPage{{}}
+			category := h.SaleLayoutCategory().NewSet(rs.Env())
+			lines := rs.OrderLine().Filtered(func(r m.SaleOrderLineSet) bool { return !r.IsOptional() })
+			for i, line := range lines.Records() {
+				if i == 0 || !line.LayoutCategory().Equals(category) {
+					category = line.LayoutCategory()
+					// If last added category induced a pagebreak, this one will be on a new page
+					lastPage := pages[len(pages)-1]
+					if len(lastPage) > 0 && lastPage[len(lastPage)-1].Pagebreak {
+						pages = append(pages, saletypes.LayoutPage{})
+					}
+					name := rs.T("Uncategorized")
+					if category.IsNotEmpty() {
+						name = category.Name()
+					}
+					pages[len(pages)-1] = append(pages[len(pages)-1], saletypes.LayoutSection{
+						Name:      name,
+						Subtotal:  category.IsNotEmpty() && category.Subtotal(),
+						Pagebreak: category.IsNotEmpty() && category.Pagebreak(),
+						Default:   category.IsEmpty(),
+					})
+				}
+				page := pages[len(pages)-1]
+				section := &page[len(page)-1]
+				section.LineIDs = append(section.LineIDs, line.ID())
+				section.SubtotalAmount += line.PriceSubtotal()
+			}
+			return pages
+		})
+
+	h.SaleOrder().Methods().LayoutSectionLines().DeclareMethod(
+		`LayoutSectionLines returns the lines of the given section of the layout of this order.`,
+		func(rs m.SaleOrderSet, section saletypes.LayoutSection) m.SaleOrderLineSet {
+			return h.SaleOrderLine().Browse(rs.Env(), section.LineIDs)
 		})
 
 	h.SaleOrder().Methods().GetTaxAmountByGroup().DeclareMethod(
@@ -744,6 +859,9 @@ based on the template if online quotation is installed.`},
 			}
 			groups := make(map[int64]float64)
 			for _, line := range rs.OrderLine().Records() {
+				if line.IsOptional() {
+					continue
+				}
 				var baseTax float64
 				for _, tax := range line.Tax().Records() {
 					priceReduce := line.PriceUnit() * (1 - line.Discount()/100)
@@ -833,7 +951,7 @@ based on the template if online quotation is installed.`},
 			Digits: decimalPrecision.GetPrecision("Product Unit of Measure")},
 		"QtyToInvoice": models.FloatField{String: "To Invoice",
 			Compute: h.SaleOrderLine().Methods().GetToInvoiceQty(), Stored: true,
-			Depends: []string{"QtyInvoiced", "QtyDelivered", "ProductUomQty", "Order.State"},
+			Depends: []string{"QtyInvoiced", "QtyDelivered", "ProductUomQty", "Order.State", "IsOptional"},
 			Digits:  decimalPrecision.GetPrecision("Product Unit of Measure")},
 		"QtyInvoiced": models.FloatField{String: "Invoiced", Compute: h.SaleOrderLine().Methods().GetInvoiceQty(),
 			Depends: []string{"InvoiceLines.Invoice.State", "InvoiceLines.Quantity"},
@@ -849,11 +967,14 @@ based on the template if online quotation is installed.`},
 		"AnalyticTags": models.Many2ManyField{String: "Analytic Tags", RelationModel: h.AccountAnalyticTag(),
 			JSON: "analytic_tag_ids"},
 		"State": models.SelectionField{String: "Order Status", Selection: types.Selection{
-			"draft":  "Quotation",
-			"sent":   "Quotation Sent",
-			"sale":   "Sale Order",
-			"done":   "Done",
-			"cancel": "Cancelled",
+			"draft":      "Quotation",
+			"sent":       "Quotation Sent",
+			"sale":       "Sale Order",
+			"done":       "Done",
+			"cancel":     "Cancelled",
+			"expired":    "Expired",
+			"to_approve": "To Approve",
+			"revised":    "Old Revision",
 		},
 			Related: "Order.State", ReadOnly: true, NoCopy: true, Default: models.DefaultValue("draft")},
 		"CustomerLead": models.IntegerField{String: "Delivery Lead Time", Required: true, GoType: new(int),
@@ -863,8 +984,29 @@ based on the template if online quotation is installed.`},
 			ReverseFK: "SaleLine", JSON: "procurement_ids"},
 		"LayoutCategory":         models.Many2OneField{String: "Section", RelationModel: h.SaleLayoutCategory()},
 		"LayoutCategorySequence": models.IntegerField{String: "Layout Sequence"},
+		"ProductWarning": models.TextField{String: "Product Warning",
+			Compute: h.SaleOrderLine().Methods().ComputeProductWarning(), Depends: []string{"Product"}},
 	})
 
+	h.SaleOrderLine().Methods().ComputeProductWarning().DeclareMethod(
+		`ComputeProductWarning computes the warning message to display for the product of this line.`,
+		func(rs m.SaleOrderLineSet) m.SaleOrderLineData {
+			warning := rs.Product().GetSaleLineWarning()
+			if warning.IsEmpty() {
+				return h.SaleOrderLine().NewData().SetProductWarning("")
+			}
+			return h.SaleOrderLine().NewData().SetProductWarning(fmt.Sprintf("%s\n%s", warning.Title, warning.Message))
+		})
+
+	h.SaleOrderLine().Methods().CheckProductWarning().DeclareMethod(
+		`CheckProductWarning panics if the given product is blocked for sales.`,
+		func(rs m.SaleOrderLineSet, product m.ProductProductSet) {
+			warning := product.GetSaleLineWarning()
+			if warning.Blocking {
+				panic(rs.T("%s\n%s", warning.Title, warning.Message))
+			}
+		})
+
 	h.SaleOrderLine().Methods().ComputeInvoiceStatus().DeclareMethod(
 		`ComputeInvoiceStatus compute the invoice status of a SO line. Possible statuses:
 
@@ -922,9 +1064,9 @@ based on the template if online quotation is installed.`},
 	h.SaleOrderLine().Methods().GetToInvoiceQty().DeclareMethod(
 		`GetToInvoiceQty compute the quantity to invoice. If the invoice policy is order,
 		the quantity to invoice is calculated from the ordered quantity. Otherwise, the quantity
-		delivered is used.`,
+		delivered is used. Optional lines have nothing to invoice.`,
 		func(rs m.SaleOrderLineSet) m.SaleOrderLineData {
-			if rs.Order().State() != "sale" && rs.Order().State() != "done" {
+			if rs.IsOptional() || (rs.Order().State() != "sale" && rs.Order().State() != "done") {
 				return h.SaleOrderLine().NewData().SetQtyToInvoice(0)
 			}
 			qtyToInvoice := rs.QtyDelivered() - rs.QtyInvoiced()
@@ -1000,6 +1142,14 @@ based on the template if online quotation is installed.`},
 			return h.SaleOrderLine().NewData().SetTax(taxes)
 		})
 
+	h.SaleOrderLine().Methods().RecomputeTax().DeclareMethod(
+		`RecomputeTax updates the taxes of the lines of this RecordSet with the result of ComputeTax.`,
+		func(rs m.SaleOrderLineSet) {
+			for _, line := range rs.Records() {
+				line.Write(line.ComputeTax())
+			}
+		})
+
 	h.SaleOrderLine().Methods().PrepareOrderLineProcurement().DeclareMethod(
 		`PrepareOrderLineProcurement returns the data to create the procurement of this sale order line.`,
 		func(rs m.SaleOrderLineSet, group m.ProcurementGroupSet) m.ProcurementOrderData {
@@ -1018,12 +1168,13 @@ based on the template if online quotation is installed.`},
 
 	h.SaleOrderLine().Methods().ActionProcurementCreate().DeclareMethod(
 		`ActionProcurementCreate creates procurements based on quantity ordered. If the quantity is increased, new
-			  procurements are created. If the quantity is decreased, no automated action is taken.`,
+			  procurements are created. If the quantity is decreased, no automated action is taken.
+			  Optional lines get no procurement until they are added to the order.`,
 		func(rs m.SaleOrderLineSet) m.ProcurementOrderSet {
 			precision := decimalPrecision.GetPrecision("Product Unit of Measure").ToPrecision()
 			newProcs := h.ProcurementOrder().NewSet(rs.Env())
 			for _, line := range rs.Records() {
-				if line.State() != "sale" || !line.Product().NeedProcurement() {
+				if line.State() != "sale" || line.IsOptional() || !line.Product().NeedProcurement() {
 					continue
 				}
 				var qty float64
@@ -1059,6 +1210,7 @@ based on the template if online quotation is installed.`},
 
 	h.SaleOrderLine().Methods().Create().Extend("",
 		func(rs m.SaleOrderLineSet, data m.SaleOrderLineData) m.SaleOrderLineSet {
+			rs.CheckProductWarning(data.Product())
 			data = rs.PrepareAddMissingFields(data)
 			line := rs.Super().Create(data)
 			if line.Order().State() == "sale" {
@@ -1071,30 +1223,12 @@ based on the template if online quotation is installed.`},
 
 	h.SaleOrderLine().Methods().Write().Extend("",
 		func(rs m.SaleOrderLineSet, data m.SaleOrderLineData) bool {
+			if data.HasProduct() {
+				rs.CheckProductWarning(data.Product())
+			}
 			lines := h.SaleOrderLine().NewSet(rs.Env())
-			changedLines := h.SaleOrderLine().NewSet(rs.Env())
 			if data.HasProductUomQty() {
 				lines = rs.Search(q.SaleOrderLine().State().Equals("sale").And().ProductUomQty().Lower(data.ProductUomQty()))
-				changedLines = rs.Search(q.SaleOrderLine().State().Equals("sale").And().ProductUomQty().NotEquals(data.ProductUomQty()))
-				if !changedLines.IsEmpty() {
-					/*
-						orders = self.mapped('order_id')
-						for order in orders:
-							order_lines = changed_lines.filtered(lambda x: x.order_id == order)
-							msg = ""
-							if any([values['product_uom_qty'] < x.product_uom_qty for x in order_lines]):
-								msg += "<b>" + _('The ordered quantity has been decreased. Do not forget to take it into account on your invoices and delivery orders.') + '</b>'
-							msg += "<ul>"
-							for line in order_lines:
-								msg += "<li> %s:" % (line.product_id.display_name,)
-								msg += "<br/>" + _("Ordered Quantity") + ": %s -> %s <br/>" % (line.product_uom_qty, float(values['product_uom_qty']),)
-								if line.product_id.type in ('consu', 'product'):
-									msg += _("Delivered Quantity") + ": %s <br/>" % (line.qty_delivered,)
-								msg += _("Invoiced Quantity") + ": %s <br/>" % (line.qty_invoiced,)
-							msg += "</ul>"
-							order.message_post(body=msg)
-					*/
-				}
 			}
 			res := rs.Super().Write(data)
 			if !lines.IsEmpty() {
@@ -1182,11 +1316,15 @@ based on the template if online quotation is installed.`},
 		})
 
 	h.SaleOrderLine().Methods().ProductChange().DeclareMethod(
-		`ProductChange updates data when product is changed in the user interface.`,
+		`ProductChange updates data when product is changed in the user interface.
+		If the product is blocked for sales, it is cleared instead.`,
 		func(rs m.SaleOrderLineSet) m.SaleOrderLineData {
 			if rs.Product().IsEmpty() {
 				return h.SaleOrderLine().NewData()
 			}
+			if rs.Product().GetSaleLineWarning().Blocking {
+				return h.SaleOrderLine().NewData().SetProduct(h.ProductProduct().NewSet(rs.Env()))
+			}
 			qty := rs.ProductUomQty()
 			data := rs.ComputeTax()
 			if rs.ProductUom().IsEmpty() || rs.Product().Uom() != rs.ProductUom() {
@@ -1212,7 +1350,6 @@ based on the template if online quotation is installed.`},
 					product.Taxes(), rs.Tax()))
 			}
 			return data
-			// TODO Add messages and domains when implemented
 		})
 
 	h.SaleOrderLine().Methods().ProductUomChange().DeclareMethod(
@@ -1224,6 +1361,13 @@ based on the template if online quotation is installed.`},
 			if rs.Order().Pricelist().IsEmpty() || rs.Order().Partner().IsEmpty() {
 				return h.SaleOrderLine().NewData()
 			}
+			return h.SaleOrderLine().NewData().SetPriceUnit(rs.PricelistPriceUnit())
+		})
+
+	h.SaleOrderLine().Methods().PricelistPriceUnit().DeclareMethod(
+		`PricelistPriceUnit returns the unit price of this line given by the pricelist of its order
+		for its product, quantity and unit of measure, with the taxes of the line.`,
+		func(rs m.SaleOrderLineSet) float64 {
 			product := rs.Product().
 				WithContext("lang", rs.Order().Partner().Lang()).
 				WithContext("partner", rs.Order().Partner().ID()).
@@ -1232,10 +1376,8 @@ based on the template if online quotation is installed.`},
 				WithContext("pricelist", rs.Order().Pricelist().ID()).
 				WithContext("uom", rs.ProductUom().ID()).
 				WithContext("fiscal_position", rs.Env().Context().GetInteger("fiscal_position"))
-			data := h.SaleOrderLine().NewData().SetPriceUnit(
-				h.AccountTax().NewSet(rs.Env()).FixTaxIncludedPrice(rs.GetDisplayPrice(product),
-					product.Taxes(), rs.Tax()))
-			return data
+			return h.AccountTax().NewSet(rs.Env()).FixTaxIncludedPrice(rs.GetDisplayPrice(product),
+				product.Taxes(), rs.Tax())
 		})
 
 	h.SaleOrderLine().Methods().Unlink().Extend("",
@@ -1256,35 +1398,7 @@ based on the template if online quotation is installed.`},
 		`GetRealPriceCurrency retrieve the price before applying the pricelist`,
 		func(rs m.SaleOrderLineSet, product m.ProductProductSet, rule m.ProductPricelistItemSet, qty float64,
 			uom m.ProductUomSet, pricelist m.ProductPricelistSet) (float64, m.CurrencySet) {
-			fieldName := "LstPrice"
-			currency := h.Currency().NewSet(rs.Env())
-			productCurrency := h.Currency().NewSet(rs.Env())
-			if rule.IsNotEmpty() {
-				pricelistItem := rule
-				if pricelistItem.Pricelist().DiscountPolicy() == "without_discount" {
-					for pricelistItem.Base() == "pricelist" && pricelistItem.BasePricelist().IsNotEmpty() &&
-						pricelistItem.BasePricelist().DiscountPolicy() == "without_discount" {
-						pricelistItem = pricelistItem.BasePricelist().GetProductPriceRule(product, qty, rs.Order().Partner(), dates.Date{}, uom)
-					}
-				}
-				if pricelistItem.Base() == "StandardPrice" {
-					fieldName = "StandardPrice"
-				}
-				if pricelistItem.Base() == "pricelist" && !pricelistItem.BasePricelist().IsEmpty() {
-					fieldName = "Price"
-					product = product.WithContext("pricelist", pricelistItem.BasePricelist().ID())
-					productCurrency = pricelistItem.BasePricelist().Currency()
-				}
-				currency = pricelistItem.Pricelist().Currency()
-			}
-
-			switch {
-			case productCurrency.IsNotEmpty():
-			case product.Company().IsNotEmpty():
-				productCurrency = product.Company().Currency()
-			default:
-				productCurrency = h.User().NewSet(rs.Env()).CurrentUser().Company().Currency()
-			}
+			fieldName, product, currency, productCurrency := realPriceBase(rs, product, rule, qty, uom)
 
 			curFactor := float64(1)
 			switch {
@@ -0,0 +1,343 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hexya-addons/saleTeams"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+// approvalLevels gives the rank of each approval level.
+// Approvals are requested in increasing rank order.
+var approvalLevels = map[string]int{
+	"team_leader": 1,
+	"manager":     2,
+}
+
+func init() {
+
+	h.SaleApprovalRule().DeclareModel()
+	h.SaleApprovalRule().SetDefaultOrder("Sequence", "ID")
+
+	h.SaleApprovalRule().AddFields(map[string]models.FieldDefinition{
+		"Name":     models.CharField{String: "Rule", Required: true, Translate: true},
+		"Sequence": models.IntegerField{Default: models.DefaultValue(10)},
+		"Active":   models.BooleanField{Default: models.DefaultValue(true)},
+		"Company": models.Many2OneField{RelationModel: h.Company(),
+			Default: func(env models.Environment) interface{} {
+				return h.Company().NewSet(env).CompanyDefaultGet()
+			}},
+		"Team": models.Many2OneField{String: "Sales Team", RelationModel: h.CRMTeam(),
+			Help: "If set, this rule only applies to the quotations of this sales team."},
+		"MinAmount": models.FloatField{String: "Total Above",
+			Help: "Quotations with a total (taxes included) above this amount need an approval. Set to 0 to ignore."},
+		"MaxDiscount": models.FloatField{String: "Line Discount Above (%)",
+			Help: "Quotations with a line discount above this percentage need an approval. Set to 0 to ignore."},
+		"MinMargin": models.FloatField{String: "Margin Below (%)",
+			Help: "Quotations with a margin below this percentage need an approval. Set to 0 to ignore."},
+		"Partners": models.Many2ManyField{String: "Customers", RelationModel: h.Partner(),
+			JSON: "partner_ids", Help: "Quotations of these customers always need an approval."},
+		"Level": models.SelectionField{String: "Approved By", Selection: types.Selection{
+			"team_leader": "Sales Team Leader",
+			"manager":     "Sales Manager",
+		}, Required: true, Default: models.DefaultValue("team_leader")},
+	})
+
+	h.SaleApprovalRule().Methods().Matches().DeclareMethod(
+		`Matches returns true if the given order needs to be approved according to this rule.`,
+		func(rs m.SaleApprovalRuleSet, order m.SaleOrderSet) bool {
+			rs.EnsureOne()
+			if rs.Company().IsNotEmpty() && !rs.Company().Equals(order.Company()) {
+				return false
+			}
+			if rs.Team().IsNotEmpty() && !rs.Team().Equals(order.Team()) {
+				return false
+			}
+			if rs.MinAmount() > 0 && order.AmountTotal() > rs.MinAmount() {
+				return true
+			}
+			if rs.MaxDiscount() > 0 {
+				for _, line := range order.OrderLine().Records() {
+					if !line.IsOptional() && line.Discount() > rs.MaxDiscount() {
+						return true
+					}
+				}
+			}
+			if rs.MinMargin() > 0 && order.AmountUntaxed() > 0 && order.ApprovalMarginPercent() < rs.MinMargin() {
+				return true
+			}
+			commercial := order.Partner().CommercialPartner()
+			for _, partner := range rs.Partners().Records() {
+				if partner.Equals(order.Partner()) || partner.Equals(commercial) {
+					return true
+				}
+			}
+			return false
+		})
+
+	h.SaleOrderApproval().DeclareModel()
+	h.SaleOrderApproval().SetDefaultOrder("ID")
+
+	h.SaleOrderApproval().AddFields(map[string]models.FieldDefinition{
+		"Order": models.Many2OneField{String: "Sales Order", RelationModel: h.SaleOrder(), Required: true,
+			OnDelete: models.Cascade, Index: true, ReadOnly: true},
+		"Rule": models.Many2OneField{String: "Rule", RelationModel: h.SaleApprovalRule(), ReadOnly: true},
+		"Level": models.SelectionField{String: "Approved By", Selection: types.Selection{
+			"team_leader": "Sales Team Leader",
+			"manager":     "Sales Manager",
+		}, Required: true, ReadOnly: true},
+		"State": models.SelectionField{String: "Status", Selection: types.Selection{
+			"pending":  "Pending",
+			"approved": "Approved",
+			"rejected": "Rejected",
+			"void":     "Voided",
+		}, Required: true, ReadOnly: true, Default: models.DefaultValue("pending"),
+			Help: "An approval is voided when the quotation is modified after it has been granted."},
+		"User": models.Many2OneField{String: "Approver", RelationModel: h.User(), ReadOnly: true},
+		"Date": models.DateTimeField{String: "Decision Date", ReadOnly: true},
+		"AmountTotal": models.FloatField{String: "Approved Total", ReadOnly: true,
+			Help: "Total of the quotation when the approval was granted."},
+		"Signature": models.CharField{ReadOnly: true, NoCopy: true,
+			Help: "Fingerprint of the quotation when the approval was granted."},
+	})
+
+	h.SaleOrderApproval().Methods().IsCurrent().DeclareMethod(
+		`IsCurrent returns true if this approval has been granted and its order has not been
+		modified since.`,
+		func(rs m.SaleOrderApprovalSet) bool {
+			rs.EnsureOne()
+			return rs.State() == "approved" && rs.Signature() == rs.Order().ApprovalSignature()
+		})
+
+	h.SaleOrder().AddFields(map[string]models.FieldDefinition{
+		"Approvals": models.One2ManyField{String: "Approvals", RelationModel: h.SaleOrderApproval(),
+			ReverseFK: "Order", JSON: "approval_ids", ReadOnly: true},
+		"CanApprove": models.BooleanField{String: "Can Approve",
+			Compute: h.SaleOrder().Methods().ComputeCanApprove()},
+	})
+
+	h.SaleOrder().Methods().ApprovalMarginPercent().DeclareMethod(
+		`ApprovalMarginPercent returns the margin of this order, in percentage of its untaxed amount,
+		computed from the cost of its products.`,
+		func(rs m.SaleOrderSet) float64 {
+			rs.EnsureOne()
+			return rs.MarginPercent()
+		})
+
+	h.SaleOrder().Methods().ApprovalSignature().DeclareMethod(
+		`ApprovalSignature returns a fingerprint of the customer, the pricelist and the lines of
+		this order. Any change to the products, quantities, prices, discounts or taxes of the
+		order gives another signature.`,
+		func(rs m.SaleOrderSet) string {
+			rs.EnsureOne()
+			var lines []string
+			for _, line := range rs.OrderLine().Records() {
+				if line.IsOptional() {
+					continue
+				}
+				taxIds := append([]int64(nil), line.Tax().Ids()...)
+				sort.Slice(taxIds, func(i, j int) bool { return taxIds[i] < taxIds[j] })
+				lines = append(lines, fmt.Sprintf("%d/%d/%s/%s/%s/%v", line.Product().ID(), line.ProductUom().ID(),
+					strconv.FormatFloat(line.ProductUomQty(), 'f', -1, 64),
+					strconv.FormatFloat(line.PriceUnit(), 'f', -1, 64),
+					strconv.FormatFloat(line.Discount(), 'f', -1, 64), taxIds))
+			}
+			sort.Strings(lines)
+			hash := sha1.New()
+			fmt.Fprintf(hash, "%d/%d\n", rs.Partner().ID(), rs.Pricelist().ID())
+			for _, line := range lines {
+				fmt.Fprintln(hash, line)
+			}
+			return hex.EncodeToString(hash.Sum(nil))
+		})
+
+	h.SaleOrder().Methods().GetApprovalRules().DeclareMethod(
+		`GetApprovalRules returns the active approval rules that apply to this order.`,
+		func(rs m.SaleOrderSet) m.SaleApprovalRuleSet {
+			rs.EnsureOne()
+			rules := h.SaleApprovalRule().Search(rs.Env(), q.SaleApprovalRule().Active().Equals(true))
+			return rules.Filtered(func(r m.SaleApprovalRuleSet) bool { return r.Matches(rs) })
+		})
+
+	h.SaleOrder().Methods().CheckApproval().DeclareMethod(
+		`CheckApproval returns true if this order can be confirmed. If the approval rules require
+		approvals that have not been granted yet, they are requested, the order is set in the
+		'to_approve' state and CheckApproval returns false.
+
+		Approvals granted before the order was last modified are voided and requested again.`,
+		func(rs m.SaleOrderSet) bool {
+			rs.EnsureOne()
+			approved := make(map[string]bool)
+			for _, approval := range rs.Approvals().Records() {
+				if approval.State() != "approved" {
+					continue
+				}
+				if !approval.IsCurrent() {
+					approval.Sudo().Write(h.SaleOrderApproval().NewData().SetState("void"))
+					continue
+				}
+				approved[approval.Level()] = true
+			}
+			data := h.SaleOrderApproval().NewData()
+			missing := make(map[string]m.SaleApprovalRuleSet)
+			for _, rule := range rs.GetApprovalRules().Records() {
+				if approved[rule.Level()] {
+					continue
+				}
+				if _, exists := missing[rule.Level()]; !exists {
+					missing[rule.Level()] = rule
+				}
+			}
+			if len(missing) == 0 {
+				return true
+			}
+			if rs.State() == "to_approve" {
+				panic(rs.T("Quotation %s is waiting for approval.", rs.Name()))
+			}
+			for level, rule := range missing {
+				h.SaleOrderApproval().NewSet(rs.Env()).Sudo().Create(data.Copy().
+					SetOrder(rs).
+					SetRule(rule).
+					SetLevel(level))
+			}
+			rs.SetState("to_approve")
+			return false
+		})
+
+	h.SaleOrder().Methods().RequestManagerApproval().DeclareMethod(
+		`RequestManagerApproval returns true if the current user is a sales manager or if
+		a sales manager has approved this order as it is. Otherwise, the approval of a sales
+		manager is requested, the order is set in the 'to_approve' state with the given reason
+		and RequestManagerApproval returns false.
+
+		It panics if the order is already waiting for approval.`,
+		func(rs m.SaleOrderSet, reason string) bool {
+			rs.EnsureOne()
+			if h.User().NewSet(rs.Env()).CurrentUser().HasGroup(saleTeams.GroupSaleManager.ID) {
+				return true
+			}
+			approvals := rs.Approvals().Filtered(func(r m.SaleOrderApprovalSet) bool {
+				return r.Level() == "manager" && r.IsCurrent()
+			})
+			if approvals.IsNotEmpty() {
+				return true
+			}
+			if rs.State() == "to_approve" {
+				panic(rs.T("Quotation %s is waiting for approval.", rs.Name()))
+			}
+			pending := rs.Approvals().Filtered(func(r m.SaleOrderApprovalSet) bool {
+				return r.Level() == "manager" && r.State() == "pending"
+			})
+			if pending.IsEmpty() {
+				h.SaleOrderApproval().NewSet(rs.Env()).Sudo().Create(h.SaleOrderApproval().NewData().
+					SetOrder(rs).
+					SetLevel("manager"))
+			}
+			rs.WithContext("state_change_reason", reason).SetState("to_approve")
+			return false
+		})
+
+	h.SaleOrder().Methods().PendingApproval().DeclareMethod(
+		`PendingApproval returns the pending approval of this order with the lowest level,
+		which is the next one to be granted.`,
+		func(rs m.SaleOrderSet) m.SaleOrderApprovalSet {
+			rs.EnsureOne()
+			res := h.SaleOrderApproval().NewSet(rs.Env())
+			for _, approval := range rs.Approvals().Records() {
+				if approval.State() != "pending" {
+					continue
+				}
+				if res.IsEmpty() || approvalLevels[approval.Level()] < approvalLevels[res.Level()] {
+					res = approval
+				}
+			}
+			return res
+		})
+
+	h.SaleOrder().Methods().UserCanApprove().DeclareMethod(
+		`UserCanApprove returns true if the given user may grant approvals of the given level on this order.
+		Sales managers may grant all approvals, and team leaders the approvals of their team's quotations.`,
+		func(rs m.SaleOrderSet, user m.UserSet, level string) bool {
+			rs.EnsureOne()
+			if user.HasGroup(saleTeams.GroupSaleManager.ID) {
+				return true
+			}
+			return level == "team_leader" && rs.Team().User().Equals(user)
+		})
+
+	h.SaleOrder().Methods().ComputeCanApprove().DeclareMethod(
+		`ComputeCanApprove computes whether the current user can grant the next approval of this order.`,
+		func(rs m.SaleOrderSet) m.SaleOrderData {
+			pending := rs.PendingApproval()
+			canApprove := rs.State() == "to_approve" && pending.IsNotEmpty() &&
+				rs.UserCanApprove(h.User().NewSet(rs.Env()).CurrentUser(), pending.Level())
+			return h.SaleOrder().NewData().SetCanApprove(canApprove)
+		})
+
+	h.SaleOrder().Methods().ActionApprove().DeclareMethod(
+		`ActionApprove grants the next pending approval of the orders of this RecordSet as the current user.
+		Once all approvals are granted, the quotation goes back to draft and can be confirmed.
+		The approval only holds for the quotation as it is when it is granted.`,
+		func(rs m.SaleOrderSet) bool {
+			user := h.User().NewSet(rs.Env()).CurrentUser()
+			for _, order := range rs.Records() {
+				pending := order.PendingApproval()
+				if order.State() != "to_approve" || pending.IsEmpty() {
+					panic(rs.T("Quotation %s is not waiting for approval.", order.Name()))
+				}
+				if !order.UserCanApprove(user, pending.Level()) {
+					panic(rs.T("You are not allowed to approve quotation %s.", order.Name()))
+				}
+				pending.Sudo().Write(h.SaleOrderApproval().NewData().
+					SetState("approved").
+					SetUser(user).
+					SetDate(dates.Now()).
+					SetAmountTotal(order.AmountTotal()).
+					SetSignature(order.ApprovalSignature()))
+				if order.PendingApproval().IsEmpty() {
+					order.WithContext("state_change_reason", rs.T("Approved by %s", user.Name())).SetState("draft")
+				}
+			}
+			return true
+		})
+
+	h.SaleOrder().Methods().ActionRejectApproval().DeclareMethod(
+		`ActionRejectApproval rejects the pending approvals of the orders of this RecordSet
+		and sets them back to draft.`,
+		func(rs m.SaleOrderSet) bool {
+			user := h.User().NewSet(rs.Env()).CurrentUser()
+			for _, order := range rs.Records() {
+				pending := order.PendingApproval()
+				if order.State() != "to_approve" || pending.IsEmpty() {
+					panic(rs.T("Quotation %s is not waiting for approval.", order.Name()))
+				}
+				if !order.UserCanApprove(user, pending.Level()) {
+					panic(rs.T("You are not allowed to reject quotation %s.", order.Name()))
+				}
+				for _, approval := range order.Approvals().Records() {
+					if approval.State() != "pending" {
+						continue
+					}
+					approval.Sudo().Write(h.SaleOrderApproval().NewData().
+						SetState("rejected").
+						SetUser(user).
+						SetDate(dates.Now()))
+				}
+				order.WithContext("state_change_reason", rs.T("Rejected by %s", user.Name())).SetState("draft")
+			}
+			return true
+		})
+
+}
@@ -0,0 +1,177 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"strings"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+func init() {
+
+	h.SaleCancelReason().DeclareModel()
+	h.SaleCancelReason().SetDefaultOrder("Name")
+
+	h.SaleCancelReason().AddFields(map[string]models.FieldDefinition{
+		"Name":   models.CharField{String: "Reason", Required: true, Translate: true},
+		"Active": models.BooleanField{Default: models.DefaultValue(true)},
+	})
+
+	h.SaleOrder().AddFields(map[string]models.FieldDefinition{
+		"CancelReason": models.Many2OneField{String: "Cancellation Reason", RelationModel: h.SaleCancelReason(),
+			ReadOnly: true, NoCopy: true, Index: true},
+	})
+
+	h.SaleOrder().Methods().PostedInvoicesWithoutRefund().DeclareMethod(
+		`PostedInvoicesWithoutRefund returns the validated customer invoices of the orders of this RecordSet
+		that have not been refunded by a validated refund.`,
+		func(rs m.SaleOrderSet) m.AccountInvoiceSet {
+			posted := h.AccountInvoice().NewSet(rs.Env())
+			for _, order := range rs.Records() {
+				posted = posted.Union(order.Invoices().Filtered(func(r m.AccountInvoiceSet) bool {
+					return r.Type() == "out_invoice" && (r.State() == "open" || r.State() == "paid")
+				}))
+			}
+			if posted.IsEmpty() {
+				return posted
+			}
+			refunds := h.AccountInvoice().Search(rs.Env(), q.AccountInvoice().
+				RefundInvoice().In(posted).
+				And().State().In([]string{"open", "paid"}))
+			for _, refund := range refunds.Records() {
+				posted = posted.Subtract(refund.RefundInvoice())
+			}
+			return posted
+		})
+
+	h.SaleOrder().Methods().RefundPostedInvoices().DeclareMethod(
+		`RefundPostedInvoices refunds the validated invoices of the orders of this RecordSet that
+		have not been refunded yet. Existing draft refunds of these invoices are validated, and a refund
+		is created and validated for the other invoices. It returns the validated refunds.`,
+		func(rs m.SaleOrderSet, description string) m.AccountInvoiceSet {
+			posted := rs.PostedInvoicesWithoutRefund()
+			if posted.IsEmpty() {
+				return h.AccountInvoice().NewSet(rs.Env())
+			}
+			refunds := h.AccountInvoice().Search(rs.Env(), q.AccountInvoice().
+				RefundInvoice().In(posted).
+				And().State().In([]string{"draft", "proforma", "proforma2"}))
+			for _, refund := range refunds.Records() {
+				posted = posted.Subtract(refund.RefundInvoice())
+			}
+			if posted.IsNotEmpty() {
+				refunds = refunds.Union(posted.Refund(dates.Today(), dates.Today(), description,
+					h.AccountJournal().NewSet(rs.Env())))
+			}
+			refunds.ActionInvoiceOpen()
+			return refunds
+		})
+
+	h.SaleOrder().Methods().CancelWithReason().DeclareMethod(
+		`CancelWithReason cancels the orders of this RecordSet for the given reason.
+
+		If refund is true, the validated invoices of the orders that have not been refunded yet
+		are refunded first. Otherwise, the cancellation fails if such invoices exist.
+		The reason is only set on the orders if they are cancelled.`,
+		func(rs m.SaleOrderSet, reason m.SaleCancelReasonSet, refund bool) bool {
+			if reason.IsEmpty() {
+				panic(rs.T("Please give a reason to cancel the order."))
+			}
+			rs = rs.WithContext("sale_cancel_reason_id", reason.ID())
+			if !refund {
+				rs.CheckCancellation()
+			}
+			rs.RefundPostedInvoices(reason.Name())
+			return rs.WithContext("state_change_reason", reason.Name()).ActionCancel()
+		})
+
+	h.SaleOrder().Methods().CancellationReason().DeclareMethod(
+		`CancellationReason returns the reason for which this order is being cancelled, that is
+		the reason given to CancelWithReason or else the cancellation reason of the order.`,
+		func(rs m.SaleOrderSet) m.SaleCancelReasonSet {
+			rs.EnsureOne()
+			if reasonID := rs.Env().Context().GetInteger("sale_cancel_reason_id"); reasonID != 0 {
+				return h.SaleCancelReason().BrowseOne(rs.Env(), reasonID)
+			}
+			return rs.CancelReason()
+		})
+
+	h.SaleOrder().Methods().CheckCancellation().DeclareMethod(
+		`CheckCancellation panics if one of the orders of this RecordSet cannot be cancelled,
+		i.e. if it has no cancellation reason or if it has validated invoices that have not been refunded.`,
+		func(rs m.SaleOrderSet) {
+			for _, order := range rs.Records() {
+				if order.CancellationReason().IsEmpty() {
+					panic(rs.T("Please give a reason to cancel %s.", order.Name()))
+				}
+				posted := order.PostedInvoicesWithoutRefund()
+				if posted.IsEmpty() {
+					continue
+				}
+				var numbers []string
+				for _, invoice := range posted.Records() {
+					numbers = append(numbers, invoice.Number())
+				}
+				panic(rs.T("%s cannot be cancelled because its invoices %s have been validated. Please refund them first.",
+					order.Name(), strings.Join(numbers, ", ")))
+			}
+		})
+
+	h.SaleOrder().Methods().CancelDraftInvoices().DeclareMethod(
+		`CancelDraftInvoices cancels the customer invoices of the orders of this RecordSet
+		that have not been validated yet.`,
+		func(rs m.SaleOrderSet) {
+			for _, order := range rs.Records() {
+				drafts := order.Invoices().Filtered(func(r m.AccountInvoiceSet) bool {
+					return r.Type() == "out_invoice" && (r.State() == "draft" || r.State() == "proforma2")
+				})
+				if drafts.IsNotEmpty() {
+					drafts.ActionInvoiceCancel()
+				}
+			}
+		})
+
+	h.SaleOrderLine().Methods().CancelProcurements().DeclareMethod(
+		`CancelProcurements cancels the procurements of the lines of this RecordSet.
+		Procurements that are already done are detached from the lines instead.`,
+		func(rs m.SaleOrderLineSet) {
+			for _, line := range rs.Records() {
+				for _, procurement := range line.Procurements().Records() {
+					if procurement.State() == "done" {
+						procurement.SetSaleLine(h.SaleOrderLine().NewSet(rs.Env()))
+						continue
+					}
+					procurement.Cancel()
+				}
+			}
+		})
+
+	h.SaleCancelWizard().DeclareTransientModel()
+
+	h.SaleCancelWizard().AddFields(map[string]models.FieldDefinition{
+		"Reason": models.Many2OneField{String: "Cancellation Reason", RelationModel: h.SaleCancelReason(),
+			Required: true},
+		"HasPostedInvoices": models.BooleanField{String: "Has Validated Invoices", ReadOnly: true,
+			Default: func(env models.Environment) interface{} {
+				orders := h.SaleOrder().Browse(env, env.Context().GetIntegerSlice("active_ids"))
+				return orders.PostedInvoicesWithoutRefund().IsNotEmpty()
+			}},
+		"Refund": models.BooleanField{String: "Refund Validated Invoices",
+			Help: "Refund the validated invoices of the orders. Existing draft refunds are validated."},
+	})
+
+	h.SaleCancelWizard().Methods().ActionCancelOrders().DeclareMethod(
+		`ActionCancelOrders cancels the orders selected in the context for the reason of this wizard.`,
+		func(rs m.SaleCancelWizardSet) bool {
+			rs.EnsureOne()
+			orders := h.SaleOrder().Browse(rs.Env(), rs.Env().Context().GetIntegerSlice("active_ids"))
+			return orders.CancelWithReason(rs.Reason(), rs.Refund())
+		})
+
+}
@@ -3,121 +3,271 @@
 
 package sale
 
+import (
+	"strconv"
+
+	"github.com/hexya-addons/base"
+	"github.com/hexya-erp/hexya/src/actions"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
 func init() {
 
-	//h.SaleConfigSettings().AddFields(map[string]models.FieldDefinition{
-	//	"CompanyId": models.Many2OneField{String: "Company", RelationModel: h.Company() /*['res.company']*/, Required: true, Default: func(env models.Environment) interface{} {
-	//		/*lambda self: self.env.user.company_id*/
-	//		return 0
-	//	}},
-	//	"SaleNote":                 models.TextField{String: "Default Terms and Conditions *" /*[related 'company_id.sale_note']*/},
-	//	"GroupProductVariant":      models.SelectionField{ /*group_product_variant = fields.Selection([ (0, "No variants on products"), (1, 'Products can have several attributes, defining variants (Example: size, color,...)')*/ },
-	//	"GroupSalePricelist":       models.BooleanField{String: "Use pricelists to adapt your price per customers", String: "Use pricelists to adapt your price per customers" /*["Use pricelists to adapt your price per customers"]*/ /*[ implied_group 'product.group_sale_pricelist']*/, Help: "Allows to manage different prices based on rules per category of customers.#~#~# Example: 10% for retailers, promotion of 5 EUR on this product, etc." /*[ promotion of 5 EUR on this product]*/ /*[ etc."""]*/},
-	//	"GroupPricelistItem":       models.BooleanField{String: "Show pricelists to customers", String: "Show pricelists to customers" /*["Show pricelists to customers"]*/ /*[ implied_group 'product.group_pricelist_item']*/},
-	//	"GroupProductPricelist":    models.BooleanField{String: "Show pricelists On Products", String: "Show pricelists On Products" /*["Show pricelists On Products"]*/ /*[ implied_group 'product.group_product_pricelist']*/},
-	//	"GroupUom":                 models.SelectionField{ /*group_uom = fields.Selection([ (0, 'Products have only one unit of measure (easier)'), (1, 'Some products may be sold/purchased in different units of measure (advanced)')*/ },
-	//	"GroupDiscountPerSoLine":   models.SelectionField{ /*group_discount_per_so_line = fields.Selection([ (0, 'No discount on sales order lines, global discount only'), (1, 'Allow discounts on sales order lines')*/ },
-	//	"GroupDisplayIncoterm":     models.SelectionField{ /*group_display_incoterm = fields.Selection([ (0, 'No incoterm on reports'), (1, 'Show incoterms on sales orders and invoices')*/ },
-	//	"ModuleSaleMargin":         models.SelectionField{ /*module_sale_margin = fields.Selection([ (0, 'Salespeople do not need to view margins when quoting'), (1, 'Display margins on quotations and sales orders')*/ },
-	//	"GroupSaleLayout":          models.SelectionField{ /*group_sale_layout = fields.Selection([ (0, 'Do not personalize sales orders and invoice reports'), (1, 'Personalize the sales orders and invoice report with categories, subtotals and page-breaks')*/ },
-	//	"GroupWarningSale":         models.SelectionField{ /*group_warning_sale = fields.Selection([ (0, 'All the products and the customers can be used in sales orders'), (1, 'An informative or blocking warning can be set on a product or a customer')*/ },
-	//	"ModuleWebsiteQuote":       models.SelectionField{ /*module_website_quote = fields.Selection([ (0, 'Print quotes or send by email'), (1, 'Send quotations your customer can approve & pay online (advanced)')*/ },
-	//	"GroupSaleDeliveryAddress": models.SelectionField{ /*group_sale_delivery_address = fields.Selection([ (0, "Invoicing and shipping addresses are always the same (Example: services companies)"), (1, 'Display 3 fields on sales orders: customer, invoice address, delivery address')*/ },
-	//	"SalePricelistSetting":     models.SelectionField{ /*sale_pricelist_setting = fields.Selection([ ('fixed', 'A single sale price per product'), ('percentage', 'Specific prices per customer segment, currency, etc.'), ('formula', 'Advanced pricing based on formulas (discounts, margins, rounding)')*/ },
-	//	"GroupShowPriceSubtotal":   models.BooleanField{String: "Show subtotal", String: "Show subtotal" /*["Show subtotal"]*/ /*[ implied_group 'sale.group_show_price_subtotal']*/ /*[ group 'base.group_portal]*/ /*[base.group_user]*/ /*[base.group_public']*/},
-	//	"GroupShowPriceTotal":      models.BooleanField{String: "Show total", String: "Show total" /*["Show total"]*/ /*[ implied_group 'sale.group_show_price_total']*/ /*[ group 'base.group_portal]*/ /*[base.group_user]*/ /*[base.group_public']*/},
-	//	"SaleShowTax": models.SelectionField{String: "Tax Display", Selection: types.Selection{
-	//		"subtotal": "Show line subtotals without taxes (B2B)",
-	//		"total":    "Show line subtotals with taxes included (B2C)",
-	//	}, /*[]*/ /*["Tax Display"]*/ Default: models.DefaultValue("subtotal"), Required: true},
-	//	"DefaultInvoicePolicy":     models.SelectionField{ /*default_invoice_policy = fields.Selection([ ('order', 'Invoice ordered quantities'), ('delivery', 'Invoice delivered quantities')*/ },
-	//	"DepositProductIdSetting":  models.Many2OneField{String: "Deposit Product", RelationModel: h.ProductProduct() /*[ 'product.product']*/ /*['Deposit Product']*/ /*, Filter: "[('type'*/ /*[ ' ']*/ /*[ 'service')]"]*/, Help: "Default product used for payment advances"},
-	//	"AutoDoneSetting":          models.SelectionField{ /*auto_done_setting = fields.Selection([ (0, "Allow to edit sales order from the 'Sales Order' menu (not from the Quotation menu)"), (1, "Never allow to modify a confirmed sales order")*/ },
-	//	"ModuleSaleContract":       models.BooleanField{String: "Manage subscriptions and recurring invoicing" /*["Manage subscriptions and recurring invoicing"]*/},
-	//	"ModuleWebsiteSaleDigital": models.BooleanField{String: "Sell digital products - provide downloadable content on your customer portal" /*["Sell digital products - provide downloadable content on your customer portal"]*/},
-	//})
-	//h.SaleConfigSettings().Methods().SetSaleDefaults().DeclareMethod(
-	//	`SetSaleDefaults`,
-	//	func(rs h.SaleConfigSettingsSet) {
-	//		//@api.multi
-	//		/*def set_sale_defaults(self):
-	//		  return self.env['ir.values'].sudo().set_default(
-	//		      'sale.config.settings', 'sale_pricelist_setting', self.sale_pricelist_setting)
-	//
-	//		*/
-	//	})
-	//h.SaleConfigSettings().Methods().SetDepositProductIdDefaults().DeclareMethod(
-	//	`SetDepositProductIdDefaults`,
-	//	func(rs h.SaleConfigSettingsSet) {
-	//		//@api.multi
-	//		/*def set_deposit_product_id_defaults(self):
-	//		  return self.env['ir.values'].sudo().set_default(
-	//		      'sale.config.settings', 'deposit_product_id_setting', self.deposit_product_id_setting.id)
-	//
-	//		*/
-	//	})
-	//h.SaleConfigSettings().Methods().SetAutoDoneDefaults().DeclareMethod(
-	//	`SetAutoDoneDefaults`,
-	//	func(rs h.SaleConfigSettingsSet) {
-	//		//@api.multi
-	//		/*def set_auto_done_defaults(self):
-	//		  return self.env['ir.values'].sudo().set_default(
-	//		      'sale.config.settings', 'auto_done_setting', self.auto_done_setting)
-	//
-	//		*/
-	//	})
-	//h.SaleConfigSettings().Methods().OnchangeSalePrice().DeclareMethod(
-	//	`OnchangeSalePrice`,
-	//	func(rs h.SaleConfigSettingsSet) {
-	//		//@api.onchange('sale_pricelist_setting')
-	//		/*def _onchange_sale_price(self):
-	//		  if self.sale_pricelist_setting == 'percentage':
-	//		      self.update({
-	//		          'group_product_pricelist': True,
-	//		          'group_sale_pricelist': True,
-	//		          'group_pricelist_item': False,
-	//		      })
-	//		  elif self.sale_pricelist_setting == 'formula':
-	//		      self.update({
-	//		          'group_product_pricelist': False,
-	//		          'group_sale_pricelist': True,
-	//		          'group_pricelist_item': True,
-	//		      })
-	//		  else:
-	//		      self.update({
-	//		          'group_product_pricelist': False,
-	//		          'group_sale_pricelist': False,
-	//		          'group_pricelist_item': False,
-	//		      })
-	//
-	//		*/
-	//	})
-	//h.SaleConfigSettings().Methods().SetSaleTaxDefaults().DeclareMethod(
-	//	`SetSaleTaxDefaults`,
-	//	func(rs h.SaleConfigSettingsSet) {
-	//		//@api.multi
-	//		/*def set_sale_tax_defaults(self):
-	//		  return self.env['ir.values'].sudo().set_default(
-	//		      'sale.config.settings', 'sale_show_tax', self.sale_show_tax)
-	//
-	//		*/
-	//	})
-	//h.SaleConfigSettings().Methods().OnchangeSaleTax().DeclareMethod(
-	//	`OnchangeSaleTax`,
-	//	func(rs h.SaleConfigSettingsSet) {
-	//		//@api.onchange('sale_show_tax')
-	//		/*def _onchange_sale_tax(self):
-	//		  if self.sale_show_tax == "subtotal":
-	//		      self.update({
-	//		          'group_show_price_total': False,
-	//		          'group_show_price_subtotal': True,
-	//		      })
-	//		  else:
-	//		      self.update({
-	//		          'group_show_price_total': True,
-	//		          'group_show_price_subtotal': False,
-	//		      })
-	//		*/
-	//	})
+	h.SaleConfigSettings().DeclareTransientModel()
+	h.SaleConfigSettings().InheritModel(h.ConfigSettings())
+
+	h.SaleConfigSettings().AddFields(map[string]models.FieldDefinition{
+		"Company": models.Many2OneField{String: "Company", RelationModel: h.Company(), Required: true,
+			Default: func(env models.Environment) interface{} {
+				return h.User().NewSet(env).CurrentUser().Company()
+			}},
+		"SaleNote": models.TextField{String: "Default Terms and Conditions *", Related: "Company.SaleNote"},
+		"QuotationValidityDays": models.IntegerField{String: "Default Quotation Validity (Days) *",
+			Related: "Company.QuotationValidityDays", GoType: new(int)},
+		"CreditLimitPolicy": models.SelectionField{String: "Credit Limit", Selection: types.Selection{
+			"block":    "Block orders exceeding the customer credit limit",
+			"approval": "Send orders exceeding the customer credit limit for approval to a sales manager",
+		}, Required: true,
+			Default: func(env models.Environment) interface{} {
+				return h.ConfigParameter().NewSet(env).Sudo().GetParam("sale.credit_limit_policy", "block")
+			}},
+		"GlobalDiscountMethod": models.SelectionField{String: "Global Discounts", Selection: types.Selection{
+			"spread": "Spread global discounts on the discount of the lines",
+			"line":   "Add discount lines for each set of taxes",
+		}, Required: true,
+			Default: func(env models.Environment) interface{} {
+				return h.ConfigParameter().NewSet(env).Sudo().GetParam("sale.global_discount_method", "line")
+			}},
+		"DiscountProductSetting": models.Many2OneField{String: "Discount Product", RelationModel: h.ProductProduct(),
+			JSON: "discount_product_id_setting", Filter: q.ProductProduct().Type().Equals("service"),
+			Help: "Product used for global discount lines",
+			Default: func(env models.Environment) interface{} {
+				conf := h.ConfigParameter().NewSet(env).Sudo().GetParam("sale.discount_product_id", "")
+				productID, err := strconv.ParseInt(conf, 10, 64)
+				if err != nil {
+					return h.ProductProduct().NewSet(env)
+				}
+				return h.ProductProduct().Browse(env, []int64{productID})
+			}},
+		"FloorPricePolicy": models.SelectionField{String: "Floor Prices", Selection: types.Selection{
+			"block":    "Forbid selling products below their floor price",
+			"approval": "Send orders with products below their floor price for approval to a sales manager",
+		}, Required: true,
+			Default: func(env models.Environment) interface{} {
+				return floorPricePolicy(env)
+			}},
+		"FloorMinMargin": models.FloatField{String: "Minimum Margin (%)",
+			Help: "Default minimum margin over cost of the products sold. Set to 0 for no minimum.",
+			Default: func(env models.Environment) interface{} {
+				conf := h.ConfigParameter().NewSet(env).Sudo().GetParam("sale.floor_min_margin", "0")
+				value, _ := strconv.ParseFloat(conf, 64)
+				return value
+			}},
+		"ExpiredQuotationPolicy": models.SelectionField{String: "Expired Quotations", Selection: types.Selection{
+			"expire": "Set expired quotations in the Expired state",
+			"cancel": "Cancel expired quotations",
+		}, Required: true,
+			Default: func(env models.Environment) interface{} {
+				return h.ConfigParameter().NewSet(env).Sudo().GetParam("sale.expired_quotation_policy", "expire")
+			}},
+		"GroupSaleDeliveryAddress": models.BooleanField{
+			String: "Display 3 fields on sales orders: customer, invoice address, delivery address",
+			Default: func(env models.Environment) interface{} {
+				return h.SaleConfigSettings().NewSet(env).HasImpliedGroup(GroupDeliveryInvoiceAddress)
+			}},
+		"GroupDiscountPerSoLine": models.BooleanField{String: "Allow discounts on sales order lines",
+			Default: func(env models.Environment) interface{} {
+				return h.SaleConfigSettings().NewSet(env).HasImpliedGroup(GroupDiscountPerSOLine)
+			}},
+		"GroupDisplayIncoterm": models.BooleanField{String: "Show incoterms on sales orders and invoices",
+			Default: func(env models.Environment) interface{} {
+				return h.SaleConfigSettings().NewSet(env).HasImpliedGroup(GroupDisplayIncoterms)
+			}},
+		"GroupSaleLayout": models.BooleanField{
+			String: "Personalize the sales orders and invoice report with categories, subtotals and page-breaks",
+			Default: func(env models.Environment) interface{} {
+				return h.SaleConfigSettings().NewSet(env).HasImpliedGroup(GroupSaleLayout)
+			}},
+		"GroupWarningSale": models.BooleanField{
+			String: "An informative or blocking warning can be set on a product or a customer",
+			Default: func(env models.Environment) interface{} {
+				return h.SaleConfigSettings().NewSet(env).HasImpliedGroup(GroupWarningSale)
+			}},
+		"GroupShowPriceSubtotal": models.BooleanField{String: "Show subtotal",
+			Default: func(env models.Environment) interface{} {
+				return h.SaleConfigSettings().NewSet(env).HasImpliedGroup(GroupShowPriceSubtotal)
+			}},
+		"GroupShowPriceTotal": models.BooleanField{String: "Show total",
+			Default: func(env models.Environment) interface{} {
+				return h.SaleConfigSettings().NewSet(env).HasImpliedGroup(GroupShowPriceTotal)
+			}},
+		"SaleShowTax": models.SelectionField{String: "Tax Display", Selection: types.Selection{
+			"subtotal": "Show line subtotals without taxes (B2B)",
+			"total":    "Show line subtotals with taxes included (B2C)",
+		}, Required: true, OnChange: h.SaleConfigSettings().Methods().OnchangeSaleTax(),
+			Default: func(env models.Environment) interface{} {
+				return h.ConfigParameter().NewSet(env).Sudo().GetParam("sale.sale_show_tax", "subtotal")
+			}},
+		"DefaultInvoicePolicy": models.SelectionField{String: "Default Invoicing Policy", Selection: types.Selection{
+			"order":    "Invoice ordered quantities",
+			"delivery": "Invoice delivered quantities",
+		}, Required: true,
+			Default: func(env models.Environment) interface{} {
+				return h.ConfigParameter().NewSet(env).Sudo().GetParam("sale.default_invoice_policy", "order")
+			}},
+		"DepositProductSetting": models.Many2OneField{String: "Deposit Product", RelationModel: h.ProductProduct(),
+			JSON: "deposit_product_id_setting", Filter: q.ProductProduct().Type().Equals("service"),
+			Help: "Default product used for payment advances",
+			Default: func(env models.Environment) interface{} {
+				return h.SaleAdvancePaymentInv().NewSet(env).DefaultProduct()
+			}},
+		"AutoDoneSetting": models.BooleanField{String: "Never allow to modify a confirmed sales order",
+			Help: `If set, sales orders are locked as soon as they are confirmed.
+Otherwise, confirmed sales orders can still be edited from the 'Sales Order' menu.`,
+			Default: func(env models.Environment) interface{} {
+				return h.ConfigParameter().NewSet(env).Sudo().GetParam("sale.auto_done_setting", "") != ""
+			}},
+	})
+
+	h.SaleConfigSettings().Methods().HasImpliedGroup().DeclareMethod(
+		`HasImpliedGroup returns true if the given group is granted to all employees.`,
+		func(rs m.SaleConfigSettingsSet, group *security.Group) bool {
+			employeeGroup := h.Group().Search(rs.Env(), q.Group().GroupID().Equals(base.GroupUser.ID))
+			employees := h.User().Search(rs.Env(), q.User().Groups().Equals(employeeGroup))
+			if employees.IsEmpty() {
+				return false
+			}
+			for _, user := range employees.Records() {
+				if !user.HasGroup(group.ID) {
+					return false
+				}
+			}
+			return true
+		})
+
+	h.SaleConfigSettings().Methods().SetImpliedGroup().DeclareMethod(
+		`SetImpliedGroup grants the given group to all employees if value is true,
+		or removes it from all employees otherwise.`,
+		func(rs m.SaleConfigSettingsSet, group *security.Group, value bool) {
+			dbGroup := h.Group().Search(rs.Env(), q.Group().GroupID().Equals(group.ID))
+			employeeGroup := h.Group().Search(rs.Env(), q.Group().GroupID().Equals(base.GroupUser.ID))
+			employees := h.User().Search(rs.Env(), q.User().Groups().Equals(employeeGroup)).Sudo()
+			for _, user := range employees.Records() {
+				if value {
+					user.SetGroups(user.Groups().Union(dbGroup))
+					continue
+				}
+				user.SetGroups(user.Groups().Subtract(dbGroup))
+			}
+			employees.SyncMemberships()
+		})
+
+	h.SaleConfigSettings().Methods().SetGroupsDefaults().DeclareMethod(
+		`SetGroupsDefaults grants or removes the groups implied by the boolean group fields of this wizard.`,
+		func(rs m.SaleConfigSettingsSet) {
+			rs.SetImpliedGroup(GroupDeliveryInvoiceAddress, rs.GroupSaleDeliveryAddress())
+			rs.SetImpliedGroup(GroupDiscountPerSOLine, rs.GroupDiscountPerSoLine())
+			rs.SetImpliedGroup(GroupDisplayIncoterms, rs.GroupDisplayIncoterm())
+			rs.SetImpliedGroup(GroupSaleLayout, rs.GroupSaleLayout())
+			rs.SetImpliedGroup(GroupWarningSale, rs.GroupWarningSale())
+			rs.SetImpliedGroup(GroupShowPriceSubtotal, rs.GroupShowPriceSubtotal())
+			rs.SetImpliedGroup(GroupShowPriceTotal, rs.GroupShowPriceTotal())
+		})
+
+	h.SaleConfigSettings().Methods().SetDepositProductIdDefaults().DeclareMethod(
+		`SetDepositProductIdDefaults saves the default product used for payment advances.`,
+		func(rs m.SaleConfigSettingsSet) {
+			var value string
+			if rs.DepositProductSetting().IsNotEmpty() {
+				value = strconv.FormatInt(rs.DepositProductSetting().ID(), 10)
+			}
+			h.ConfigParameter().NewSet(rs.Env()).Sudo().SetParam("deposit_product_id_setting", value)
+		})
+
+	h.SaleConfigSettings().Methods().SetAutoDoneDefaults().DeclareMethod(
+		`SetAutoDoneDefaults saves whether sale orders are locked upon confirmation.`,
+		func(rs m.SaleConfigSettingsSet) {
+			var value string
+			if rs.AutoDoneSetting() {
+				value = "1"
+			}
+			h.ConfigParameter().NewSet(rs.Env()).Sudo().SetParam("sale.auto_done_setting", value)
+		})
+
+	h.SaleConfigSettings().Methods().SetInvoicePolicyDefaults().DeclareMethod(
+		`SetInvoicePolicyDefaults saves the invoicing policy set by default on new products.`,
+		func(rs m.SaleConfigSettingsSet) {
+			h.ConfigParameter().NewSet(rs.Env()).Sudo().SetParam("sale.default_invoice_policy", rs.DefaultInvoicePolicy())
+		})
+
+	h.SaleConfigSettings().Methods().SetExpiredQuotationPolicyDefaults().DeclareMethod(
+		`SetExpiredQuotationPolicyDefaults saves what happens to quotations past their validity date.`,
+		func(rs m.SaleConfigSettingsSet) {
+			h.ConfigParameter().NewSet(rs.Env()).Sudo().SetParam("sale.expired_quotation_policy", rs.ExpiredQuotationPolicy())
+		})
+
+	h.SaleConfigSettings().Methods().SetCreditLimitPolicyDefaults().DeclareMethod(
+		`SetCreditLimitPolicyDefaults saves what happens to orders exceeding the customer credit limit.`,
+		func(rs m.SaleConfigSettingsSet) {
+			h.ConfigParameter().NewSet(rs.Env()).Sudo().SetParam("sale.credit_limit_policy", rs.CreditLimitPolicy())
+		})
+
+	h.SaleConfigSettings().Methods().SetGlobalDiscountDefaults().DeclareMethod(
+		`SetGlobalDiscountDefaults saves how global discounts are applied and the product of discount lines.`,
+		func(rs m.SaleConfigSettingsSet) {
+			var value string
+			if rs.DiscountProductSetting().IsNotEmpty() {
+				value = strconv.FormatInt(rs.DiscountProductSetting().ID(), 10)
+			}
+			h.ConfigParameter().NewSet(rs.Env()).Sudo().SetParam("sale.discount_product_id", value)
+			h.ConfigParameter().NewSet(rs.Env()).Sudo().SetParam("sale.global_discount_method", rs.GlobalDiscountMethod())
+		})
+
+	h.SaleConfigSettings().Methods().SetFloorPriceDefaults().DeclareMethod(
+		`SetFloorPriceDefaults saves the default minimum margin and what happens to lines sold below their floor price.`,
+		func(rs m.SaleConfigSettingsSet) {
+			h.ConfigParameter().NewSet(rs.Env()).Sudo().SetParam("sale.floor_price_policy", rs.FloorPricePolicy())
+			h.ConfigParameter().NewSet(rs.Env()).Sudo().SetParam("sale.floor_min_margin",
+				strconv.FormatFloat(rs.FloorMinMargin(), 'f', -1, 64))
+		})
+
+	h.SaleConfigSettings().Methods().SetSaleTaxDefaults().DeclareMethod(
+		`SetSaleTaxDefaults saves the way line subtotals are displayed (with or without taxes).`,
+		func(rs m.SaleConfigSettingsSet) {
+			h.ConfigParameter().NewSet(rs.Env()).Sudo().SetParam("sale.sale_show_tax", rs.SaleShowTax())
+		})
+
+	h.SaleConfigSettings().Methods().OnchangeSaleTax().DeclareMethod(
+		`OnchangeSaleTax sets the subtotal display groups according to the selected tax display.`,
+		func(rs m.SaleConfigSettingsSet) m.SaleConfigSettingsData {
+			if rs.SaleShowTax() == "subtotal" {
+				return h.SaleConfigSettings().NewData().
+					SetGroupShowPriceTotal(false).
+					SetGroupShowPriceSubtotal(true)
+			}
+			return h.SaleConfigSettings().NewData().
+				SetGroupShowPriceTotal(true).
+				SetGroupShowPriceSubtotal(false)
+		})
+
+	h.SaleConfigSettings().Methods().Execute().Extend("",
+		func(rs m.SaleConfigSettingsSet) *actions.Action {
+			res := rs.Super().Execute()
+			rs.SetDepositProductIdDefaults()
+			rs.SetAutoDoneDefaults()
+			rs.SetInvoicePolicyDefaults()
+			rs.SetSaleTaxDefaults()
+			rs.SetExpiredQuotationPolicyDefaults()
+			rs.SetCreditLimitPolicyDefaults()
+			rs.SetGlobalDiscountDefaults()
+			rs.SetFloorPriceDefaults()
+			rs.SetGroupsDefaults()
+			return res
+		})
 
 }
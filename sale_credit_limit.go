@@ -0,0 +1,105 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"github.com/hexya-addons/sale/saletypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+// creditLimitPolicy returns what happens to orders exceeding the credit limit of their customer:
+// 'block' forbids their confirmation, 'approval' sends them for approval to a sales manager.
+func creditLimitPolicy(env models.Environment) string {
+	return h.ConfigParameter().NewSet(env).Sudo().GetParam("sale.credit_limit_policy", "block")
+}
+
+func init() {
+
+	h.Partner().Fields().CreditLimit().
+		SetString("Credit Limit").
+		SetHelp(`Maximum amount this customer may owe, including confirmed orders not invoiced yet.
+Set to 0 for no limit. The limit of the commercial entity applies to all its contacts.`)
+
+	h.Partner().Methods().SaleCreditExposure().DeclareMethod(
+		`SaleCreditExposure returns the amount owed by the commercial entity of this partner,
+		that is its open receivables plus the amount still to invoice on its confirmed orders.
+		The amount is expressed in the currency of the company of the current user.`,
+		func(rs m.PartnerSet) float64 {
+			commercial := rs.CommercialPartner()
+			contacts := h.Partner().Search(rs.Env(), q.Partner().CommercialPartner().Equals(commercial))
+			orders := h.SaleOrder().Search(rs.Env(), q.SaleOrder().
+				Partner().In(contacts.Union(commercial)).
+				And().State().In([]string{"sale", "done"}).
+				And().InvoiceStatus().Equals("to invoice"))
+			companyCurrency := h.User().NewSet(rs.Env()).CurrentUser().Company().Currency()
+			exposure := commercial.Credit()
+			for _, order := range orders.Records() {
+				var toInvoice float64
+				for _, line := range order.OrderLine().Records() {
+					toInvoice += line.QtyToInvoice() * line.PriceReduceTaxInc()
+				}
+				exposure += order.Currency().Compute(toInvoice, companyCurrency, true)
+			}
+			return exposure
+		})
+
+	h.SaleOrder().Methods().CreditLimitExceeded().DeclareMethod(
+		`CreditLimitExceeded returns true and the error describing it if confirming this order
+		would exceed the credit limit of the customer. Amounts are compared in the currency
+		of the company of the current user.`,
+		func(rs m.SaleOrderSet) (saletypes.CreditLimitError, bool) {
+			rs.EnsureOne()
+			commercial := rs.Partner().CommercialPartner()
+			limit := commercial.CreditLimit()
+			if limit <= 0 {
+				return saletypes.CreditLimitError{}, false
+			}
+			currency := h.User().NewSet(rs.Env()).CurrentUser().Company().Currency()
+			exposure := commercial.SaleCreditExposure() + rs.Currency().Compute(rs.AmountTotal(), currency, true)
+			if exposure <= limit {
+				return saletypes.CreditLimitError{}, false
+			}
+			return saletypes.CreditLimitError{
+				Partner:  commercial.Name(),
+				Limit:    limit,
+				Exposure: exposure,
+				Message: rs.T("Cannot confirm %s: %s would owe %s, which exceeds its credit limit of %s.",
+					rs.Name(), commercial.Name(), formatAmount(exposure, currency), formatAmount(limit, currency)),
+			}, true
+		})
+
+	h.SaleOrder().Methods().CheckCreditLimit().DeclareMethod(
+		`CheckCreditLimit panics with a saletypes.CreditLimitError if confirming this order
+		would exceed the credit limit of the customer and the sale.credit_limit_policy
+		parameter is set to 'block'.
+
+		With the 'approval' policy, CheckApproval sends the order for approval to a
+		sales manager instead.`,
+		func(rs m.SaleOrderSet) {
+			if creditLimitPolicy(rs.Env()) != "block" {
+				return
+			}
+			if err, exceeded := rs.CreditLimitExceeded(); exceeded {
+				panic(err)
+			}
+		})
+
+	h.SaleOrder().Methods().CheckApproval().Extend("",
+		func(rs m.SaleOrderSet) bool {
+			if !rs.Super().CheckApproval() {
+				return false
+			}
+			if creditLimitPolicy(rs.Env()) != "approval" {
+				return true
+			}
+			if _, exceeded := rs.CreditLimitExceeded(); !exceeded {
+				return true
+			}
+			return rs.RequestManagerApproval(rs.T("Credit limit of %s exceeded", rs.Partner().CommercialPartner().Name()))
+		})
+
+}
@@ -0,0 +1,337 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+// discountLinesData returns the data of the lines that deduct the given percentage
+// of the amount of the given lines from the order.
+//
+// One line is returned for each set of taxes of the given lines, so that the discount
+// is deducted from the base of the right taxes. The name of each line is the given name
+// followed by its taxes.
+func discountLinesData(order m.SaleOrderSet, lines m.SaleOrderLineSet, percent float64, name string) []m.SaleOrderLineData {
+	type taxGroup struct {
+		taxes  m.AccountTaxSet
+		amount float64
+	}
+	groups := make(map[string]*taxGroup)
+	var keys []string
+	for _, line := range lines.Records() {
+		ids := make([]string, 0, line.Tax().Len())
+		for _, id := range line.Tax().Ids() {
+			ids = append(ids, strconv.FormatInt(id, 10))
+		}
+		sort.Strings(ids)
+		key := strings.Join(ids, ",")
+		if _, exists := groups[key]; !exists {
+			groups[key] = &taxGroup{taxes: line.Tax()}
+			keys = append(keys, key)
+		}
+		groups[key].amount += line.PriceUnit() * line.ProductUomQty() * (1 - line.Discount()/100)
+	}
+	product := order.DiscountProduct()
+	var res []m.SaleOrderLineData
+	for _, key := range keys {
+		group := groups[key]
+		if group.amount == 0 {
+			continue
+		}
+		lineName := name
+		if group.taxes.IsNotEmpty() {
+			var taxNames []string
+			for _, tax := range group.taxes.Records() {
+				taxNames = append(taxNames, tax.Name())
+			}
+			lineName = order.T("%s - On products with taxes %s", name, strings.Join(taxNames, ", "))
+		}
+		res = append(res, h.SaleOrderLine().NewData().
+			SetOrder(order).
+			SetSequence(9999).
+			SetProduct(product).
+			SetName(lineName).
+			SetProductUomQty(1).
+			SetProductUom(product.Uom()).
+			SetPriceUnit(-order.Currency().Round(group.amount*percent/100)).
+			SetTax(group.taxes))
+	}
+	return res
+}
+
+func init() {
+
+	h.SaleOrder().AddFields(map[string]models.FieldDefinition{
+		"GlobalDiscountType": models.SelectionField{String: "Global Discount Type", Selection: types.Selection{
+			"percent": "Percentage",
+			"fixed":   "Fixed Amount",
+		}, Required: true, ReadOnlyFunc: readOnlyUnlessQuotation, Default: models.DefaultValue("percent")},
+		"GlobalDiscount": models.FloatField{String: "Global Discount", ReadOnlyFunc: readOnlyUnlessQuotation,
+			Help: "Discount on the whole order, in percentage or as an amount deducted from the untaxed amount."},
+		"GlobalDiscountMethod": models.SelectionField{String: "Apply Global Discount", Selection: types.Selection{
+			"spread": "Spread on lines",
+			"line":   "Discount lines",
+		}, Required: true, ReadOnlyFunc: readOnlyUnlessQuotation,
+			Default: func(env models.Environment) interface{} {
+				return h.ConfigParameter().NewSet(env).Sudo().GetParam("sale.global_discount_method", "line")
+			},
+			Help: `Spread on lines: the global discount is added to the discount of each line.
+Discount lines: a negative line is added for each set of taxes of the order.`},
+	})
+
+	h.SaleOrderLine().AddFields(map[string]models.FieldDefinition{
+		"IsDiscountLine": models.BooleanField{String: "Global Discount Line", ReadOnly: true,
+			Help: "This line holds the global discount of the order for the lines with the same taxes."},
+		"GlobalDiscountSpread": models.BooleanField{String: "Global Discount Spread", ReadOnly: true},
+		"LineDiscount": models.FloatField{String: "Line Discount (%)", ReadOnly: true,
+			Help: "Discount of this line before the global discount of the order was spread on it."},
+	})
+
+	h.SaleOrder().Methods().DiscountProduct().DeclareMethod(
+		`DiscountProduct returns the product of the global discount lines.
+		It is created if it has not been set in the sales settings.`,
+		func(rs m.SaleOrderSet) m.ProductProductSet {
+			conf := h.ConfigParameter().NewSet(rs.Env()).Sudo().GetParam("sale.discount_product_id", "")
+			if productID, err := strconv.ParseInt(conf, 10, 64); err == nil {
+				product := h.ProductProduct().Browse(rs.Env(), []int64{productID})
+				if product.IsNotEmpty() {
+					return product
+				}
+			}
+			product := h.ProductProduct().NewSet(rs.Env()).Sudo().Create(h.ProductProduct().NewData().
+				SetName(rs.T("Discount")).
+				SetType("service").
+				SetInvoicePolicy("order").
+				SetSaleOk(false).
+				SetPurchaseOk(false))
+			h.ConfigParameter().NewSet(rs.Env()).Sudo().SetParam("sale.discount_product_id",
+				fmt.Sprintf("%d", product.ID()))
+			return h.ProductProduct().Browse(rs.Env(), product.Ids())
+		})
+
+	h.SaleOrder().Methods().DiscountLines().DeclareMethod(
+		`DiscountLines returns the global discount lines of this order.`,
+		func(rs m.SaleOrderSet) m.SaleOrderLineSet {
+			rs.EnsureOne()
+			return rs.OrderLine().Filtered(func(r m.SaleOrderLineSet) bool { return r.IsDiscountLine() })
+		})
+
+	h.SaleOrder().Methods().GlobalDiscountBaseLines().DeclareMethod(
+		`GlobalDiscountBaseLines returns the lines of this order on which the global discount applies,
+		i.e. all lines except optional lines, discount lines and promotion rewards.`,
+		func(rs m.SaleOrderSet) m.SaleOrderLineSet {
+			rs.EnsureOne()
+			return rs.OrderLine().Filtered(func(r m.SaleOrderLineSet) bool {
+				return !r.IsOptional() && !r.IsDiscountLine() && r.Promotion().IsEmpty()
+			})
+		})
+
+	h.SaleOrder().Methods().ResetGlobalDiscount().DeclareMethod(
+		`ResetGlobalDiscount removes the global discount from the lines of the orders of this RecordSet:
+		discount lines are deleted and the lines on which the discount was spread get their own discount back.`,
+		func(rs m.SaleOrderSet) {
+			rs = rs.WithContext("sale_global_discount", true)
+			for _, order := range rs.Records() {
+				if discountLines := order.DiscountLines(); discountLines.IsNotEmpty() {
+					discountLines.Unlink()
+				}
+				for _, line := range order.OrderLine().Records() {
+					if !line.GlobalDiscountSpread() {
+						continue
+					}
+					line.Write(h.SaleOrderLine().NewData().
+						SetDiscount(line.LineDiscount()).
+						SetGlobalDiscountSpread(false).
+						SetLineDiscount(0))
+				}
+			}
+		})
+
+	h.SaleOrder().Methods().GlobalDiscountPercent().DeclareMethod(
+		`GlobalDiscountPercent returns the global discount of this order as a percentage of
+		the untaxed amount of the lines it applies to.`,
+		func(rs m.SaleOrderSet) float64 {
+			rs.EnsureOne()
+			if rs.GlobalDiscountType() == "percent" {
+				return math.Min(rs.GlobalDiscount(), 100)
+			}
+			var base float64
+			for _, line := range rs.GlobalDiscountBaseLines().Records() {
+				base += line.PriceSubtotal()
+			}
+			if base <= 0 {
+				return 0
+			}
+			return math.Min(rs.GlobalDiscount()/base*100, 100)
+		})
+
+	h.SaleOrder().Methods().ApplyGlobalDiscount().DeclareMethod(
+		`ApplyGlobalDiscount applies the global discount of the quotations of this RecordSet
+		according to their global discount method. The previous global discount is removed first,
+		so that this method can be called as many times as needed.`,
+		func(rs m.SaleOrderSet) bool {
+			for _, order := range rs.Records() {
+				if order.State() != "draft" && order.State() != "sent" {
+					panic(rs.T("Global discounts can only be applied to quotations, but %s is not a quotation.", order.Name()))
+				}
+			}
+			rs.ResetGlobalDiscount()
+			rs = rs.WithContext("sale_global_discount", true)
+			for _, order := range rs.Records() {
+				percent := order.GlobalDiscountPercent()
+				if percent <= 0 {
+					continue
+				}
+				if order.GlobalDiscountMethod() == "spread" {
+					order.SpreadGlobalDiscount(percent)
+					continue
+				}
+				order.CreateDiscountLines(percent)
+			}
+			return true
+		})
+
+	h.SaleOrder().Methods().SpreadGlobalDiscount().DeclareMethod(
+		`SpreadGlobalDiscount adds the given discount percentage to the discount of each line of this order.`,
+		func(rs m.SaleOrderSet, percent float64) {
+			rs.EnsureOne()
+			for _, line := range rs.GlobalDiscountBaseLines().Records() {
+				discount := 100 - (100-line.Discount())*(100-percent)/100
+				line.Write(h.SaleOrderLine().NewData().
+					SetLineDiscount(line.Discount()).
+					SetGlobalDiscountSpread(true).
+					SetDiscount(discount))
+			}
+		})
+
+	h.SaleOrder().Methods().CreateDiscountLines().DeclareMethod(
+		`CreateDiscountLines creates a global discount line of the given percentage for each set of taxes
+		of the lines of this order, so that the discount is deducted from the base of the right taxes.`,
+		func(rs m.SaleOrderSet, percent float64) {
+			rs.EnsureOne()
+			name := rs.T("Discount %s%%", strconv.FormatFloat(percent, 'f', -1, 64))
+			if rs.GlobalDiscountType() == "fixed" {
+				name = rs.T("Discount")
+			}
+			for _, data := range discountLinesData(rs, rs.GlobalDiscountBaseLines(), percent, name) {
+				h.SaleOrderLine().Create(rs.Env(), data.SetIsDiscountLine(true))
+			}
+		})
+
+	h.SaleOrder().Methods().UpdateGlobalDiscount().DeclareMethod(
+		`UpdateGlobalDiscount applies again the global discount of the quotations of this RecordSet
+		that have one, so that it matches their current lines. Other orders are left untouched.`,
+		func(rs m.SaleOrderSet) {
+			if rs.Env().Context().GetBool("sale_global_discount") {
+				return
+			}
+			quotations := rs.Filtered(func(r m.SaleOrderSet) bool {
+				return (r.State() == "draft" || r.State() == "sent") &&
+					(r.GlobalDiscount() != 0 || r.DiscountLines().IsNotEmpty())
+			})
+			if quotations.IsNotEmpty() {
+				quotations.ApplyGlobalDiscount()
+			}
+		})
+
+	h.SaleOrder().Methods().Write().Extend("",
+		func(rs m.SaleOrderSet, data m.SaleOrderData) bool {
+			res := rs.Super().Write(data)
+			if !data.HasGlobalDiscount() && !data.HasGlobalDiscountType() && !data.HasGlobalDiscountMethod() &&
+				!data.HasFiscalPosition() && !data.HasOrderLine() {
+				return res
+			}
+			rs.UpdateGlobalDiscount()
+			return res
+		})
+
+	h.SaleOrder().Methods().ActionConfirm().Extend("",
+		func(rs m.SaleOrderSet) bool {
+			rs.UpdateGlobalDiscount()
+			return rs.Super().ActionConfirm()
+		})
+
+	h.SaleOrder().Methods().Create().Extend("",
+		func(rs m.SaleOrderSet, data m.SaleOrderData) m.SaleOrderSet {
+			order := rs.Super().Create(data)
+			if order.GlobalDiscount() != 0 && (order.State() == "draft" || order.State() == "sent") {
+				order.ApplyGlobalDiscount()
+			}
+			return order
+		})
+
+	h.SaleOrder().Methods().ActionRecomputeTaxes().Extend("",
+		func(rs m.SaleOrderSet) bool {
+			res := rs.Super().ActionRecomputeTaxes()
+			rs.ApplyGlobalDiscount()
+			return res
+		})
+
+	h.SaleOrderLine().Methods().ComputeTax().Extend("",
+		func(rs m.SaleOrderLineSet) m.SaleOrderLineData {
+			if rs.IsDiscountLine() {
+				// Discount lines keep the taxes of the lines they discount
+				return h.SaleOrderLine().NewData().SetTax(rs.Tax())
+			}
+			return rs.Super().ComputeTax()
+		})
+
+	h.SaleOrderLine().Methods().GlobalDiscountOrders().DeclareMethod(
+		`GlobalDiscountOrders returns the orders of the lines of this RecordSet on which the global discount
+		applies, i.e. the orders whose global discount must be updated when these lines change.`,
+		func(rs m.SaleOrderLineSet) m.SaleOrderSet {
+			orders := h.SaleOrder().NewSet(rs.Env())
+			for _, line := range rs.Records() {
+				if line.IsDiscountLine() || line.Promotion().IsNotEmpty() {
+					continue
+				}
+				orders = orders.Union(line.Order())
+			}
+			return orders
+		})
+
+	h.SaleOrderLine().Methods().Create().Extend("",
+		func(rs m.SaleOrderLineSet, data m.SaleOrderLineData) m.SaleOrderLineSet {
+			line := rs.Super().Create(data)
+			line.GlobalDiscountOrders().UpdateGlobalDiscount()
+			return line
+		})
+
+	h.SaleOrderLine().Methods().Write().Extend("",
+		func(rs m.SaleOrderLineSet, data m.SaleOrderLineData) bool {
+			if rs.Env().Context().GetBool("sale_global_discount") {
+				return rs.Super().Write(data)
+			}
+			if data.HasDiscount() {
+				// A discount set by hand replaces the discount the global discount was spread on.
+				data.SetGlobalDiscountSpread(false)
+				data.SetLineDiscount(0)
+			}
+			res := rs.Super().Write(data)
+			if data.HasProduct() || data.HasProductUomQty() || data.HasProductUom() || data.HasPriceUnit() ||
+				data.HasDiscount() || data.HasTax() || data.HasIsOptional() {
+				rs.GlobalDiscountOrders().UpdateGlobalDiscount()
+			}
+			return res
+		})
+
+	h.SaleOrderLine().Methods().Unlink().Extend("",
+		func(rs m.SaleOrderLineSet) int64 {
+			orders := rs.GlobalDiscountOrders()
+			res := rs.Super().Unlink()
+			orders.UpdateGlobalDiscount()
+			return res
+		})
+
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hexya-addons/saleTeams"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+// QuotationExpiryInterval is the interval between two runs of the job that
+// expires the quotations past their validity date.
+//
+// Set it to 0 before the server starts to disable the job.
+var QuotationExpiryInterval = 6 * time.Hour
+
+// expireQuotation expires the given quotation, or cancels it if policy is 'cancel'.
+// It returns the error that prevented it, if any.
+func expireQuotation(order m.SaleOrderSet, policy string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	order = order.WithContext("state_change_reason", order.T("Quotation expired on %s", order.ValidityDate().String()))
+	if policy == "cancel" {
+		order.CancelWithReason(h.SaleCancelReason().NewSet(order.Env()).GetRecord("sale_cancel_reason_expired"), false)
+		return nil
+	}
+	order.SetState("expired")
+	return nil
+}
+
+func init() {
+
+	registerScheduledJob("sale_expire_quotations", &QuotationExpiryInterval, func(env models.Environment) {
+		h.SaleOrder().NewSet(env).ExpireQuotations()
+	})
+
+	h.SaleOrder().Methods().IsExpired().DeclareMethod(
+		`IsExpired returns true if this order is a quotation past its validity date.`,
+		func(rs m.SaleOrderSet) bool {
+			rs.EnsureOne()
+			switch rs.State() {
+			case "expired":
+				return true
+			case "draft", "sent":
+				return !rs.ValidityDate().IsZero() && rs.ValidityDate().Lower(dates.Today())
+			}
+			return false
+		})
+
+	h.SaleOrder().Methods().CheckValidity().DeclareMethod(
+		`CheckValidity panics if this quotation has expired, unless the current user is a sales manager.`,
+		func(rs m.SaleOrderSet) {
+			if !rs.IsExpired() {
+				return
+			}
+			if h.User().NewSet(rs.Env()).CurrentUser().HasGroup(saleTeams.GroupSaleManager.ID) {
+				return
+			}
+			panic(rs.T("Quotation %s expired on %s. Only a sales manager can confirm it.",
+				rs.Name(), rs.ValidityDate().String()))
+		})
+
+	h.SaleOrder().Methods().ExpireQuotations().DeclareMethod(
+		`ExpireQuotations sets all the quotations past their validity date in the expired state,
+		or cancels them if the sale.expired_quotation_policy parameter is set to 'cancel'.
+
+		Quotations that cannot be expired, for instance because they have validated invoices,
+		are logged and left untouched so that they do not prevent the others from expiring.
+		It returns the quotations that have expired.`,
+		func(rs m.SaleOrderSet) m.SaleOrderSet {
+			orders := h.SaleOrder().Search(rs.Env(), q.SaleOrder().
+				State().In([]string{"draft", "sent"}).
+				And().ValidityDate().Lower(dates.Today())).
+				Filtered(func(r m.SaleOrderSet) bool {
+					return !r.ValidityDate().IsZero()
+				})
+			expired := h.SaleOrder().NewSet(rs.Env())
+			if orders.IsEmpty() {
+				return expired
+			}
+			policy := h.ConfigParameter().NewSet(rs.Env()).Sudo().GetParam("sale.expired_quotation_policy", "expire")
+			for _, order := range orders.Records() {
+				if err := expireQuotation(order, policy); err != nil {
+					log.Warn("Unable to expire quotation", "order", order.Name(), "error", err)
+					continue
+				}
+				expired = expired.Union(order)
+			}
+			return expired
+		})
+
+	h.SaleOrder().Methods().ActionDraft().Extend("",
+		func(rs m.SaleOrderSet) bool {
+			expired := rs.Filtered(func(r m.SaleOrderSet) bool { return r.State() == "expired" })
+			res := rs.Super().ActionDraft()
+			for _, order := range expired.Records() {
+				// Give a new validity period to the quotation
+				if days := order.Company().QuotationValidityDays(); days > 0 {
+					order.SetValidityDate(dates.Today().AddDate(0, 0, days))
+				}
+			}
+			return res
+		})
+
+}
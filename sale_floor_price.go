@@ -0,0 +1,148 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+// floorPricePolicy returns what happens to lines sold below their floor price:
+// 'block' forbids them, 'approval' sends their order for approval to a sales manager.
+func floorPricePolicy(env models.Environment) string {
+	return h.ConfigParameter().NewSet(env).Sudo().GetParam("sale.floor_price_policy", "block")
+}
+
+func init() {
+
+	h.ProductTemplate().AddFields(map[string]models.FieldDefinition{
+		"MinSalePrice": models.FloatField{String: "Minimum Sale Price",
+			Help: "This product cannot be sold below this price (after discount), in the company currency. Set to 0 for no minimum."},
+	})
+
+	h.ProductPricelist().AddFields(map[string]models.FieldDefinition{
+		"FloorMinMargin": models.FloatField{String: "Minimum Margin (%)",
+			Help: "Products cannot be sold with this pricelist with a margin over cost below this percentage. If 0, the minimum margin of the sales settings applies."},
+	})
+
+	h.SaleOrderLine().Methods().FloorPrice().DeclareMethod(
+		`FloorPrice returns the lowest unit price (after discount) at which the product of this line
+		can be sold, in the currency of the order and the unit of measure of the line.
+
+		The floor price is the highest of the minimum sale price of the product and of the price
+		that gives the minimum margin of the pricelist, or of the sales settings if not set on the pricelist.
+		It is 0 if no floor applies.`,
+		func(rs m.SaleOrderLineSet) float64 {
+			rs.EnsureOne()
+			if rs.Product().IsEmpty() {
+				return 0
+			}
+			var floor float64
+			if minPrice := rs.Product().MinSalePrice(); minPrice > 0 {
+				floor = rs.ConvertProductPrice(minPrice)
+			}
+			minMargin := rs.Order().Pricelist().FloorMinMargin()
+			if minMargin == 0 {
+				conf := h.ConfigParameter().NewSet(rs.Env()).Sudo().GetParam("sale.floor_min_margin", "0")
+				minMargin, _ = strconv.ParseFloat(conf, 64)
+			}
+			if minMargin > 0 && minMargin < 100 && rs.PurchasePrice() > 0 {
+				floor = math.Max(floor, rs.PurchasePrice()/(1-minMargin/100))
+			}
+			return floor
+		})
+
+	h.SaleOrderLine().Methods().BelowFloorPrice().DeclareMethod(
+		`BelowFloorPrice returns true if this line is sold below its floor price.
+		Optional lines, global discount lines and promotion rewards are never below their floor price.`,
+		func(rs m.SaleOrderLineSet) bool {
+			rs.EnsureOne()
+			if rs.IsOptional() || rs.IsDiscountLine() || rs.Promotion().IsNotEmpty() {
+				return false
+			}
+			floor := rs.FloorPrice()
+			if floor <= 0 {
+				return false
+			}
+			price := rs.PriceUnit() * (1 - rs.Discount()/100)
+			return rs.Order().Currency().CompareAmounts(price, floor) < 0
+		})
+
+	h.SaleOrderLine().Methods().FloorPriceViolations().DeclareMethod(
+		`FloorPriceViolations returns the lines of this RecordSet that are sold below their floor price.
+		It is empty if the current user may override floor prices.`,
+		func(rs m.SaleOrderLineSet) m.SaleOrderLineSet {
+			if h.User().NewSet(rs.Env()).CurrentUser().HasGroup(GroupSalePriceOverride.ID) {
+				return h.SaleOrderLine().NewSet(rs.Env())
+			}
+			return rs.Filtered(func(r m.SaleOrderLineSet) bool { return r.BelowFloorPrice() })
+		})
+
+	h.SaleOrderLine().Methods().CheckFloorPrice().DeclareMethod(
+		`CheckFloorPrice panics if lines of this RecordSet are sold below their floor price
+		and the sale.floor_price_policy parameter is set to 'block'.`,
+		func(rs m.SaleOrderLineSet) {
+			if floorPricePolicy(rs.Env()) != "block" {
+				return
+			}
+			violations := rs.FloorPriceViolations()
+			if violations.IsEmpty() {
+				return
+			}
+			var msgs []string
+			for _, line := range violations.Records() {
+				currency := line.Order().Currency()
+				msgs = append(msgs, rs.T("%s: %s (minimum %s)", line.Product().NameGet(),
+					formatAmount(line.PriceUnit()*(1-line.Discount()/100), currency),
+					formatAmount(line.FloorPrice(), currency)))
+			}
+			panic(rs.T("The following products cannot be sold at this price:\n%s", strings.Join(msgs, "\n")))
+		})
+
+	h.SaleOrderLine().Methods().Create().Extend("",
+		func(rs m.SaleOrderLineSet, data m.SaleOrderLineData) m.SaleOrderLineSet {
+			line := rs.Super().Create(data)
+			if data.HasPriceUnit() && !forcedWrite(rs.Env()) {
+				line.CheckFloorPrice()
+			}
+			return line
+		})
+
+	h.SaleOrderLine().Methods().Write().Extend("",
+		func(rs m.SaleOrderLineSet, data m.SaleOrderLineData) bool {
+			res := rs.Super().Write(data)
+			if forcedWrite(rs.Env()) {
+				return res
+			}
+			if data.HasPriceUnit() || data.HasDiscount() || data.HasProduct() || data.HasProductUom() {
+				rs.CheckFloorPrice()
+			}
+			return res
+		})
+
+	h.SaleOrder().Methods().ActionConfirm().Extend("",
+		func(rs m.SaleOrderSet) bool {
+			for _, order := range rs.Records() {
+				order.OrderLine().CheckFloorPrice()
+			}
+			return rs.Super().ActionConfirm()
+		})
+
+	h.SaleOrder().Methods().CheckApproval().Extend("",
+		func(rs m.SaleOrderSet) bool {
+			if !rs.Super().CheckApproval() {
+				return false
+			}
+			if floorPricePolicy(rs.Env()) != "approval" || rs.OrderLine().FloorPriceViolations().IsEmpty() {
+				return true
+			}
+			return rs.RequestManagerApproval(rs.T("Products sold below their floor price"))
+		})
+
+}
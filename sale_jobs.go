@@ -0,0 +1,61 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+)
+
+// A scheduledJob is a function run periodically in the background
+// with superuser rights once the server has started.
+type scheduledJob struct {
+	name string
+	// interval points to the variable holding the time between two runs,
+	// so that it can be changed before the server starts. A null interval disables the job.
+	interval *time.Duration
+	run      func(env models.Environment)
+}
+
+// scheduledJobs are the jobs started by startScheduledJobs
+var scheduledJobs []scheduledJob
+
+// registerScheduledJob adds a job that runs the given function every interval.
+func registerScheduledJob(name string, interval *time.Duration, run func(env models.Environment)) {
+	scheduledJobs = append(scheduledJobs, scheduledJob{name: name, interval: interval, run: run})
+}
+
+// runScheduledJob runs once the job with the given name in the given environment.
+func runScheduledJob(env models.Environment, name string) {
+	for _, job := range scheduledJobs {
+		if job.name == name {
+			job.run(env)
+			return
+		}
+	}
+	panic(fmt.Errorf("unknown scheduled job %s", name))
+}
+
+// startScheduledJobs starts all the registered jobs in the background.
+// Each run is executed in its own transaction.
+func startScheduledJobs() {
+	for _, job := range scheduledJobs {
+		if *job.interval <= 0 {
+			continue
+		}
+		go func(job scheduledJob) {
+			for range time.Tick(*job.interval) {
+				err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+					runScheduledJob(env, job.name)
+				})
+				if err != nil {
+					log.Warn("Scheduled job failed", "job", job.name, "error", err)
+				}
+			}
+		}(job)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/hexya-addons/sale/saletypes"
+	"github.com/hexya-erp/hexya/src/actions"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+// MailTransport is the transport used to dispatch the e-mails sent by this module.
+//
+// It defaults to a LogTransport which only logs messages. Set it to an
+// SMTPTransport or any other MailTransport to actually deliver e-mails.
+var MailTransport saletypes.MailTransport = new(LogTransport)
+
+// MailQueueInterval is the interval between two runs of the job that dispatches
+// the outgoing mails and retries the failed ones.
+//
+// Set it to 0 before the server starts to disable the job.
+var MailQueueInterval = 15 * time.Minute
+
+// A LogTransport is a MailTransport that writes messages to the log
+// instead of delivering them.
+type LogTransport struct{}
+
+// Send the given message to the log
+func (lt *LogTransport) Send(msg saletypes.MailMessage) error {
+	log.Info("Sending e-mail", "from", msg.From, "to", msg.To, "subject", msg.Subject,
+		"attachments", len(msg.Attachments))
+	return nil
+}
+
+var _ saletypes.MailTransport = new(LogTransport)
+
+// An SMTPTransport is a MailTransport that delivers messages through an SMTP server.
+type SMTPTransport struct {
+	// Addr is the address of the SMTP server in the form "host:port"
+	Addr string
+	// Auth is the authentication mechanism to use. Leave nil for no authentication.
+	Auth smtp.Auth
+}
+
+// Send the given message through the SMTP server of this transport
+func (st *SMTPTransport) Send(msg saletypes.MailMessage) error {
+	from, err := mail.ParseAddress(msg.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender address %s: %s", msg.From, err)
+	}
+	to := make([]string, len(msg.To))
+	for i, rcpt := range msg.To {
+		addr, err := mail.ParseAddress(rcpt)
+		if err != nil {
+			return fmt.Errorf("invalid recipient address %s: %s", rcpt, err)
+		}
+		to[i] = addr.Address
+	}
+	data, err := buildMIMEMessage(msg)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(st.Addr, st.Auth, from.Address, to, data)
+}
+
+var _ saletypes.MailTransport = new(SMTPTransport)
+
+// buildMIMEMessage returns the given message as a multipart MIME document
+func buildMIMEMessage(msg saletypes.MailMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "From: %s\r\n", msg.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(msg.To, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", dates.Now().Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+
+	body, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/html; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err = body.Write([]byte(encodeBase64Lines([]byte(msg.Body)))); err != nil {
+		return nil, err
+	}
+	for _, attachment := range msg.Attachments {
+		part, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {attachment.ContentType},
+			"Content-Transfer-Encoding": {"base64"},
+			"Content-Disposition": {mime.FormatMediaType("attachment",
+				map[string]string{"filename": attachment.Name})},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err = part.Write([]byte(encodeBase64Lines(attachment.Content))); err != nil {
+			return nil, err
+		}
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeBase64Lines returns the base64 encoding of data split in lines of 76 characters
+func encodeBase64Lines(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var res strings.Builder
+	for len(encoded) > 76 {
+		res.WriteString(encoded[:76])
+		res.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	res.WriteString(encoded)
+	return res.String()
+}
+
+func init() {
+
+	registerScheduledJob("sale_process_mail_queue", &MailQueueInterval, func(env models.Environment) {
+		h.SaleMail().NewSet(env).ProcessQueue()
+	})
+
+	h.SaleMail().DeclareModel()
+	h.SaleMail().SetDefaultOrder("ID desc")
+
+	h.SaleMail().AddFields(map[string]models.FieldDefinition{
+		"Order": models.Many2OneField{String: "Sales Order", RelationModel: h.SaleOrder(), Required: true,
+			OnDelete: models.Cascade, Index: true},
+		"Kind": models.SelectionField{String: "Type", Selection: types.Selection{
+			"quotation":    "Quotation",
+			"confirmation": "Order Confirmation",
+		}, Required: true, Default: models.DefaultValue("quotation")},
+		"EmailFrom": models.CharField{String: "From", Required: true},
+		"EmailTo":   models.CharField{String: "To", Required: true, Help: "Comma separated list of recipients"},
+		"Subject":   models.CharField{String: "Subject"},
+		"Body":      models.HTMLField{String: "Contents"},
+		"Attachments": models.Many2ManyField{String: "Attachments", RelationModel: h.Attachment(),
+			JSON: "attachment_ids"},
+		"State": models.SelectionField{String: "Status", Selection: types.Selection{
+			"draft":     "Draft",
+			"outgoing":  "Outgoing",
+			"sent":      "Sent",
+			"exception": "Delivery Failed",
+		}, ReadOnly: true, NoCopy: true, Default: models.DefaultValue("outgoing")},
+		"DateSent":      models.DateTimeField{String: "Sent On", ReadOnly: true, NoCopy: true},
+		"FailureReason": models.TextField{String: "Failure Reason", ReadOnly: true, NoCopy: true},
+	})
+
+	h.SaleMail().Methods().PrepareMessage().DeclareMethod(
+		`PrepareMessage returns the MailMessage to dispatch for this mail`,
+		func(rs m.SaleMailSet) saletypes.MailMessage {
+			rs.EnsureOne()
+			msg := saletypes.MailMessage{
+				From:    rs.EmailFrom(),
+				Subject: rs.Subject(),
+				Body:    rs.Body(),
+			}
+			for _, rcpt := range strings.Split(rs.EmailTo(), ",") {
+				if strings.TrimSpace(rcpt) == "" {
+					continue
+				}
+				msg.To = append(msg.To, strings.TrimSpace(rcpt))
+			}
+			for _, attachment := range rs.Attachments().Records() {
+				content, err := base64.StdEncoding.DecodeString(attachment.Datas())
+				if err != nil {
+					panic(rs.T("Unable to read attachment %s: %s", attachment.Name(), err))
+				}
+				msg.Attachments = append(msg.Attachments, saletypes.MailAttachment{
+					Name:        attachment.DatasFname(),
+					ContentType: attachment.MimeType(),
+					Content:     content,
+				})
+			}
+			return msg
+		})
+
+	h.SaleMail().Methods().Send().DeclareMethod(
+		`Send dispatches the mails of this RecordSet that have not been sent yet through
+		the MailTransport. Mails that cannot be dispatched are set in the exception state.
+
+		Quotations are marked as sent only once their mail has been dispatched.
+		It returns true if all the mails have been dispatched.`,
+		func(rs m.SaleMailSet) bool {
+			res := true
+			for _, saleMail := range rs.Records() {
+				if saleMail.State() == "sent" {
+					continue
+				}
+				if err := MailTransport.Send(saleMail.PrepareMessage()); err != nil {
+					log.Warn("Unable to send e-mail", "mail", saleMail.ID(), "order", saleMail.Order().Name(), "error", err)
+					saleMail.Write(h.SaleMail().NewData().
+						SetState("exception").
+						SetFailureReason(err.Error()))
+					res = false
+					continue
+				}
+				saleMail.Write(h.SaleMail().NewData().
+					SetState("sent").
+					SetDateSent(dates.Now()).
+					SetFailureReason(""))
+				if saleMail.Order().State() == "draft" {
+					saleMail.Order().SetState("sent")
+				}
+			}
+			return res
+		})
+
+	h.SaleMail().Methods().ActionSend().DeclareMethod(
+		`ActionSend dispatches this mail from the compose form and closes it.`,
+		func(rs m.SaleMailSet) *actions.Action {
+			rs.SetState("outgoing")
+			if !rs.Send() {
+				panic(rs.T("The e-mail could not be sent: %s", rs.FailureReason()))
+			}
+			return &actions.Action{
+				Type: actions.ActionCloseWindow,
+			}
+		})
+
+	h.SaleMail().Methods().ProcessQueue().DeclareMethod(
+		`ProcessQueue tries to dispatch all outgoing and failed mails.
+
+		Draft mails are never sent: they are mails whose compose window is still open or
+		has been discarded. The drafts older than one day are deleted with their attachments.`,
+		func(rs m.SaleMailSet) bool {
+			drafts := h.SaleMail().Search(rs.Env(), q.SaleMail().State().Equals("draft").
+				And().CreateDate().Lower(dates.Now().AddDate(0, 0, -1)))
+			if drafts.IsNotEmpty() {
+				drafts.Unlink()
+			}
+			mails := h.SaleMail().Search(rs.Env(), q.SaleMail().State().In([]string{"outgoing", "exception"}))
+			return mails.Send()
+		})
+
+	h.SaleMail().Methods().Unlink().Extend("",
+		func(rs m.SaleMailSet) int64 {
+			// The attachments of drafts have only been rendered for the compose window
+			attachments := h.Attachment().NewSet(rs.Env())
+			for _, saleMail := range rs.Records() {
+				if saleMail.State() == "draft" {
+					attachments = attachments.Union(saleMail.Attachments())
+				}
+			}
+			res := rs.Super().Unlink()
+			if attachments.IsNotEmpty() {
+				attachments.Unlink()
+			}
+			return res
+		})
+
+	h.SaleOrder().Methods().PrepareQuotationMail().DeclareMethod(
+		`PrepareQuotationMail returns the data of the mail to send this order to the customer,
+		rendered from the sale.email_template_edi_sale template with the quotation document
+		attached. The mail is a quotation or an order confirmation depending on the order state.`,
+		func(rs m.SaleOrderSet) m.SaleMailData {
+			rs.EnsureOne()
+			if rs.Partner().Email() == "" {
+				panic(rs.T("Cannot send %s: customer %s has no e-mail address.", rs.Name(), rs.Partner().Name()))
+			}
+			lang := rs.Partner().Lang()
+			if lang == "" {
+				lang = rs.Env().Context().GetString("lang")
+			}
+			order := rs.WithContext("lang", lang)
+			kind := "quotation"
+			subject := order.T("%s Quotation (Ref %s)", rs.Company().Name(), rs.Name())
+			if rs.State() == "sale" || rs.State() == "done" {
+				kind = "confirmation"
+				subject = order.T("%s Order (Ref %s)", rs.Company().Name(), rs.Name())
+			}
+			values := order.GetReportValues()
+			values["partner_name"] = rs.Partner().Name()
+			values["company_name"] = rs.Company().Name()
+			values["signature"] = rs.User().Signature()
+			body, err := renderTemplate(lang, "sale.email_template_edi_sale", values)
+			if err != nil {
+				panic(rs.T("Unable to render the quotation e-mail: %s", err))
+			}
+			fileName := fmt.Sprintf("%s%s.html", strings.TrimSuffix(values["title"].(string), "#"), rs.Name())
+			attachment := h.Attachment().Create(rs.Env(), h.Attachment().NewData().
+				SetName(fileName).
+				SetDatasFname(fileName).
+				SetResModel("SaleOrder").
+				SetResID(rs.ID()).
+				SetMimeType("text/html").
+				SetDatas(base64.StdEncoding.EncodeToString(order.RenderHTML())))
+			emailFrom := rs.Company().Partner().EmailFormatted()
+			if rs.Company().Email() == "" {
+				emailFrom = rs.User().Partner().EmailFormatted()
+			}
+			return h.SaleMail().NewData().
+				SetOrder(rs).
+				SetKind(kind).
+				SetEmailFrom(emailFrom).
+				SetEmailTo(rs.Partner().EmailFormatted()).
+				SetSubject(subject).
+				SetBody(string(body)).
+				SetAttachments(attachment)
+		})
+
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+func init() {
+
+	h.SaleOrderLine().AddFields(map[string]models.FieldDefinition{
+		"PurchasePrice": models.FloatField{String: "Cost",
+			Compute: h.SaleOrderLine().Methods().ComputePurchasePrice(), Stored: true,
+			Depends: []string{"Product", "ProductUom", "Order.Pricelist"},
+			Help:    "Cost of the product in the currency of the order and the unit of measure of the line."},
+		"Margin": models.FloatField{String: "Margin",
+			Compute: h.SaleOrderLine().Methods().ComputeMargin(), Stored: true,
+			Depends: []string{"PriceSubtotal", "PurchasePrice", "ProductUomQty"}},
+		"MarginPercent": models.FloatField{String: "Margin (%)",
+			Compute: h.SaleOrderLine().Methods().ComputeMargin(), Stored: true,
+			Depends: []string{"PriceSubtotal", "PurchasePrice", "ProductUomQty"}},
+	})
+
+	h.SaleOrderLine().Methods().ConvertProductPrice().DeclareMethod(
+		`ConvertProductPrice converts the given price of the product of this line, expressed in the
+		company currency and the unit of measure of the product, to the currency of the order and
+		the unit of measure of the line.`,
+		func(rs m.SaleOrderLineSet, price float64) float64 {
+			if rs.ProductUom().IsNotEmpty() && !rs.ProductUom().Equals(rs.Product().Uom()) {
+				price = rs.Product().Uom().ComputePrice(price, rs.ProductUom())
+			}
+			currency := rs.Order().Company().Currency()
+			if currency.IsNotEmpty() && rs.Order().Currency().IsNotEmpty() && !currency.Equals(rs.Order().Currency()) {
+				price = currency.WithContext("date", rs.Order().DateOrder().ToDate()).Compute(price, rs.Order().Currency(), false)
+			}
+			return price
+		})
+
+	h.SaleOrderLine().Methods().ComputePurchasePrice().DeclareMethod(
+		`ComputePurchasePrice returns the cost of the product of this line, converted
+		from the company currency to the currency of the order and from the unit of
+		measure of the product to the unit of measure of the line.`,
+		func(rs m.SaleOrderLineSet) m.SaleOrderLineData {
+			if rs.Product().IsEmpty() {
+				return h.SaleOrderLine().NewData().SetPurchasePrice(0)
+			}
+			return h.SaleOrderLine().NewData().SetPurchasePrice(rs.ConvertProductPrice(rs.Product().StandardPrice()))
+		})
+
+	h.SaleOrderLine().Methods().ComputeMargin().DeclareMethod(
+		`ComputeMargin computes the margin of this line, i.e. its untaxed subtotal minus the cost
+		of its products, and the margin in percentage of the subtotal.`,
+		func(rs m.SaleOrderLineSet) m.SaleOrderLineData {
+			margin := rs.PriceSubtotal() - rs.PurchasePrice()*rs.ProductUomQty()
+			var percent float64
+			if rs.PriceSubtotal() != 0 {
+				percent = margin / rs.PriceSubtotal() * 100
+			}
+			return h.SaleOrderLine().NewData().
+				SetMargin(rs.Order().Currency().Round(margin)).
+				SetMarginPercent(percent)
+		})
+
+	h.SaleOrder().AddFields(map[string]models.FieldDefinition{
+		"Margin": models.FloatField{String: "Margin",
+			Compute: h.SaleOrder().Methods().ComputeMargin(), Stored: true,
+			Depends: []string{"OrderLine.Margin", "OrderLine.IsOptional", "AmountUntaxed"},
+			Help:    "Untaxed amount of the order minus the cost of its products. Optional lines are not counted."},
+		"MarginPercent": models.FloatField{String: "Margin (%)",
+			Compute: h.SaleOrder().Methods().ComputeMargin(), Stored: true,
+			Depends: []string{"OrderLine.Margin", "OrderLine.IsOptional", "AmountUntaxed"}},
+	})
+
+	h.SaleOrder().Methods().ComputeMargin().DeclareMethod(
+		`ComputeMargin computes the margin of this order by summing the margin of its lines,
+		and the margin in percentage of the untaxed amount.`,
+		func(rs m.SaleOrderSet) m.SaleOrderData {
+			var margin float64
+			for _, line := range rs.OrderLine().Records() {
+				if line.IsOptional() {
+					continue
+				}
+				margin += line.Margin()
+			}
+			var percent float64
+			if rs.AmountUntaxed() != 0 {
+				percent = margin / rs.AmountUntaxed() * 100
+			}
+			return h.SaleOrder().NewData().
+				SetMargin(margin).
+				SetMarginPercent(percent)
+		})
+
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+func init() {
+
+	h.ProductTemplate().AddFields(map[string]models.FieldDefinition{
+		"OptionalProducts": models.Many2ManyField{String: "Optional Products", RelationModel: h.ProductTemplate(),
+			JSON: "optional_product_ids", M2MLinkModelName: "ProductOptionalRel",
+			M2MOurField: "Product", M2MTheirField: "Optional",
+			Help: "Products proposed to the customer as optional lines when this product is sold."},
+	})
+
+	h.SaleOrderLine().AddFields(map[string]models.FieldDefinition{
+		"IsOptional": models.BooleanField{String: "Optional", Index: true,
+			Help: "Optional lines are shown on the quotation but are neither counted in the totals, nor invoiced or delivered until they are added to the order."},
+	})
+
+	h.SaleOrderLine().Methods().ApplyProductChange().DeclareMethod(
+		`ApplyProductChange sets the description, price and taxes of the lines of this RecordSet
+		as if their product had been selected in the user interface.
+		The quantity and unit of measure of the lines are kept.`,
+		func(rs m.SaleOrderLineSet) {
+			for _, line := range rs.Records() {
+				line.Write(line.ProductChange().
+					UnsetProductUom().
+					UnsetProductUomQty())
+				line.Write(line.ProductUomChange())
+			}
+		})
+
+	h.SaleOrderLine().Methods().ActionAddOptional().DeclareMethod(
+		`ActionAddOptional adds the optional lines of this RecordSet to their order,
+		so that they are counted in the totals and invoiced and delivered as the other lines.`,
+		func(rs m.SaleOrderLineSet) bool {
+			for _, line := range rs.Records() {
+				if !line.IsOptional() {
+					continue
+				}
+				if line.Order().State() != "draft" && line.Order().State() != "sent" && line.Order().State() != "sale" {
+					panic(rs.T("Optional products cannot be added to %s anymore.", line.Order().Name()))
+				}
+				line.SetIsOptional(false)
+				if line.Order().State() == "sale" {
+					line.ActionProcurementCreate()
+				}
+			}
+			return true
+		})
+
+	h.SaleOrderLine().Methods().Write().Extend("",
+		func(rs m.SaleOrderLineSet, data m.SaleOrderLineData) bool {
+			if data.HasIsOptional() && data.IsOptional() {
+				for _, line := range rs.Records() {
+					if !line.IsOptional() && line.Order().State() != "draft" && line.Order().State() != "sent" {
+						panic(rs.T("Only the lines of quotations can be made optional."))
+					}
+				}
+			}
+			return rs.Super().Write(data)
+		})
+
+	h.SaleOrder().Methods().OptionalLines().DeclareMethod(
+		`OptionalLines returns the optional lines of this order.`,
+		func(rs m.SaleOrderSet) m.SaleOrderLineSet {
+			rs.EnsureOne()
+			return rs.OrderLine().Filtered(func(r m.SaleOrderLineSet) bool { return r.IsOptional() })
+		})
+
+	h.SaleOrder().Methods().SuggestedOptionalProducts().DeclareMethod(
+		`SuggestedOptionalProducts returns the optional products of the products sold in this order
+		that are not in the order yet.`,
+		func(rs m.SaleOrderSet) m.ProductProductSet {
+			rs.EnsureOne()
+			products := h.ProductProduct().NewSet(rs.Env())
+			for _, line := range rs.OrderLine().Records() {
+				if line.IsOptional() {
+					continue
+				}
+				for _, tmpl := range line.Product().ProductTmpl().OptionalProducts().Records() {
+					products = products.Union(tmpl.ProductVariants())
+				}
+			}
+			for _, line := range rs.OrderLine().Records() {
+				products = products.Subtract(line.Product())
+			}
+			return products.Filtered(func(r m.ProductProductSet) bool { return r.SaleOk() })
+		})
+
+	h.SaleOrder().Methods().ActionAddSuggestedOptionals().DeclareMethod(
+		`ActionAddSuggestedOptionals adds an optional line to the quotations of this RecordSet
+		for each of their suggested optional products.`,
+		func(rs m.SaleOrderSet) bool {
+			for _, order := range rs.Records() {
+				if order.State() != "draft" && order.State() != "sent" {
+					panic(rs.T("Optional products can only be suggested on quotations, but %s is not a quotation.", order.Name()))
+				}
+				for _, product := range order.SuggestedOptionalProducts().Records() {
+					h.SaleOrderLine().Create(rs.Env(), h.SaleOrderLine().NewData().
+						SetOrder(order).
+						SetProduct(product).
+						SetName(product.NameGet()).
+						SetProductUomQty(1).
+						SetProductUom(product.Uom()).
+						SetIsOptional(true)).
+						ApplyProductChange()
+				}
+			}
+			return true
+		})
+
+}
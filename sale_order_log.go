@@ -0,0 +1,188 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+// formatQuantity returns the given quantity as a string without trailing zeros
+func formatQuantity(qty float64) string {
+	return strconv.FormatFloat(qty, 'f', -1, 64)
+}
+
+func init() {
+
+	h.SaleOrderLog().DeclareModel()
+	h.SaleOrderLog().SetDefaultOrder("Date desc", "ID desc")
+
+	h.SaleOrderLog().AddFields(map[string]models.FieldDefinition{
+		"Order": models.Many2OneField{String: "Sales Order", RelationModel: h.SaleOrder(), Required: true,
+			OnDelete: models.Cascade, Index: true, ReadOnly: true},
+		"OrderLine": models.Many2OneField{String: "Order Line", RelationModel: h.SaleOrderLine(),
+			OnDelete: models.SetNull, ReadOnly: true},
+		"Date": models.DateTimeField{String: "Date", Required: true, ReadOnly: true,
+			Default: func(env models.Environment) interface{} {
+				return dates.Now()
+			}},
+		"User": models.Many2OneField{String: "Changed By", RelationModel: h.User(), ReadOnly: true,
+			Default: func(env models.Environment) interface{} {
+				return h.User().NewSet(env).CurrentUser()
+			}},
+		"Kind": models.SelectionField{String: "Change", Selection: types.Selection{
+			"state":           "Status",
+			"salesperson":     "Salesperson",
+			"quantity":        "Ordered Quantity",
+			"price":           "Unit Price",
+			"discount":        "Discount",
+			"payment":         "Payment",
+			"revision":        "Revision",
+			"price_breakdown": "Price Breakdown",
+			"price_manual":    "Manual Price",
+		}, Required: true, ReadOnly: true},
+		"OldValue": models.CharField{String: "Old Value", ReadOnly: true},
+		"NewValue": models.CharField{String: "New Value", ReadOnly: true},
+		"Message":  models.TextField{String: "Message", ReadOnly: true},
+	})
+
+	h.SaleOrder().AddFields(map[string]models.FieldDefinition{
+		"ChangeLogs": models.One2ManyField{String: "History", RelationModel: h.SaleOrderLog(),
+			ReverseFK: "Order", JSON: "log_ids", ReadOnly: true},
+	})
+
+	h.SaleOrder().Methods().LogChange().DeclareMethod(
+		`LogChange records the given change in the history of this order.
+		The change is attributed to the current user.`,
+		func(rs m.SaleOrderSet, data m.SaleOrderLogData) m.SaleOrderLogSet {
+			rs.EnsureOne()
+			data.SetOrder(rs)
+			if data.User().IsEmpty() {
+				data.SetUser(h.User().NewSet(rs.Env()).CurrentUser())
+			}
+			return h.SaleOrderLog().NewSet(rs.Env()).Sudo().Create(data)
+		})
+
+	h.SaleOrder().Methods().StateChangeMessage().DeclareMethod(
+		`StateChangeMessage returns the history message for this order going from oldState to state.
+		If the 'state_change_reason' context key is set, it is appended to the message when the
+		change is recorded.`,
+		func(rs m.SaleOrderSet, oldState, state string) string {
+			switch state {
+			case "draft":
+				return rs.T("Order set back to quotation")
+			case "sent":
+				return rs.T("Quotation sent")
+			case "sale":
+				if oldState == "done" {
+					return rs.T("Order unlocked by %s", h.User().NewSet(rs.Env()).CurrentUser().Name())
+				}
+				return rs.T("Quotation confirmed")
+			case "done":
+				return rs.T("Order locked")
+			case "cancel":
+				return rs.T("Order cancelled")
+			case "expired":
+				return rs.T("Quotation expired")
+			case "to_approve":
+				return rs.T("Quotation submitted for approval")
+			}
+			return ""
+		})
+
+	h.SaleOrder().Methods().Write().Extend("",
+		func(rs m.SaleOrderSet, data m.SaleOrderData) bool {
+			var logs []m.SaleOrderLogData
+			var orders []m.SaleOrderSet
+			for _, order := range rs.Records() {
+				if data.HasState() && data.State() != order.State() {
+					msg := order.StateChangeMessage(order.State(), data.State())
+					if reason := rs.Env().Context().GetString("state_change_reason"); reason != "" {
+						msg = fmt.Sprintf("%s: %s", msg, reason)
+					}
+					logs = append(logs, h.SaleOrderLog().NewData().
+						SetKind("state").
+						SetOldValue(order.State()).
+						SetNewValue(data.State()).
+						SetMessage(msg))
+					orders = append(orders, order)
+				}
+				if data.HasUser() && !data.User().Equals(order.User()) {
+					logs = append(logs, h.SaleOrderLog().NewData().
+						SetKind("salesperson").
+						SetOldValue(order.User().Name()).
+						SetNewValue(data.User().Name()).
+						SetMessage(rs.T("Salesperson changed from %s to %s", order.User().Name(), data.User().Name())))
+					orders = append(orders, order)
+				}
+			}
+			res := rs.Super().Write(data)
+			for i, logData := range logs {
+				orders[i].LogChange(logData)
+			}
+			return res
+		})
+
+	h.SaleOrderLine().Methods().Write().Extend("",
+		func(rs m.SaleOrderLineSet, data m.SaleOrderLineData) bool {
+			var logs []m.SaleOrderLogData
+			var orders []m.SaleOrderSet
+			for _, line := range rs.Records() {
+				productName := line.Product().NameGet()
+				if data.HasProductUomQty() && line.State() == "sale" && data.ProductUomQty() != line.ProductUomQty() {
+					var msg []string
+					if data.ProductUomQty() < line.ProductUomQty() {
+						msg = append(msg, rs.T("The ordered quantity has been decreased. Do not forget to take it into account on your invoices and delivery orders."))
+					}
+					msg = append(msg, fmt.Sprintf("%s:", productName),
+						rs.T("Ordered Quantity: %s -> %s", formatQuantity(line.ProductUomQty()), formatQuantity(data.ProductUomQty())))
+					if line.Product().Type() == "consu" || line.Product().Type() == "product" {
+						msg = append(msg, rs.T("Delivered Quantity: %s", formatQuantity(line.QtyDelivered())))
+					}
+					msg = append(msg, rs.T("Invoiced Quantity: %s", formatQuantity(line.QtyInvoiced())))
+					logs = append(logs, h.SaleOrderLog().NewData().
+						SetOrderLine(line).
+						SetKind("quantity").
+						SetOldValue(formatQuantity(line.ProductUomQty())).
+						SetNewValue(formatQuantity(data.ProductUomQty())).
+						SetMessage(strings.Join(msg, "\n")))
+					orders = append(orders, line.Order())
+				}
+				if data.HasPriceUnit() && data.PriceUnit() != line.PriceUnit() {
+					currency := line.Order().Pricelist().Currency()
+					oldPrice, newPrice := formatAmount(line.PriceUnit(), currency), formatAmount(data.PriceUnit(), currency)
+					logs = append(logs, h.SaleOrderLog().NewData().
+						SetOrderLine(line).
+						SetKind("price").
+						SetOldValue(oldPrice).
+						SetNewValue(newPrice).
+						SetMessage(rs.T("%s: Unit Price: %s -> %s", productName, oldPrice, newPrice)))
+					orders = append(orders, line.Order())
+				}
+				if data.HasDiscount() && data.Discount() != line.Discount() {
+					oldDiscount, newDiscount := formatQuantity(line.Discount())+"%", formatQuantity(data.Discount())+"%"
+					logs = append(logs, h.SaleOrderLog().NewData().
+						SetOrderLine(line).
+						SetKind("discount").
+						SetOldValue(oldDiscount).
+						SetNewValue(newDiscount).
+						SetMessage(rs.T("%s: Discount: %s -> %s", productName, oldDiscount, newDiscount)))
+					orders = append(orders, line.Order())
+				}
+			}
+			res := rs.Super().Write(data)
+			for i, logData := range logs {
+				orders[i].LogChange(logData)
+			}
+			return res
+		})
+
+}
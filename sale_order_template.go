@@ -0,0 +1,217 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+func init() {
+
+	h.SaleOrderTemplate().DeclareModel()
+	h.SaleOrderTemplate().SetDefaultOrder("Name")
+
+	h.SaleOrderTemplate().AddFields(map[string]models.FieldDefinition{
+		"Name":   models.CharField{String: "Quotation Template", Required: true, Translate: true},
+		"Active": models.BooleanField{Default: models.DefaultValue(true)},
+		"Company": models.Many2OneField{RelationModel: h.Company(),
+			Default: func(env models.Environment) interface{} {
+				return h.Company().NewSet(env).CompanyDefaultGet()
+			}},
+		"Lines": models.One2ManyField{String: "Lines", RelationModel: h.SaleOrderTemplateLine(),
+			ReverseFK: "Template", JSON: "template_line_ids", Copy: true},
+		"ValidityDays": models.IntegerField{String: "Quotation Validity (Days)", GoType: new(int),
+			Help: "Number of days during which quotations made from this template are valid. Set to 0 to use the default validity of the company."},
+		"Note": models.TextField{String: "Terms and conditions", Translate: true,
+			Help: "If set, replaces the terms and conditions of the quotations made from this template."},
+	})
+
+	h.SaleOrderTemplateLine().DeclareModel()
+	h.SaleOrderTemplateLine().SetDefaultOrder("Template", "Sequence", "ID")
+
+	h.SaleOrderTemplateLine().AddFields(map[string]models.FieldDefinition{
+		"Template": models.Many2OneField{String: "Quotation Template", RelationModel: h.SaleOrderTemplate(),
+			Required: true, OnDelete: models.Cascade, Index: true},
+		"Sequence": models.IntegerField{Default: models.DefaultValue(10)},
+		"Product": models.Many2OneField{String: "Product", RelationModel: h.ProductProduct(), Required: true,
+			Filter: q.ProductProduct().SaleOk().Equals(true), OnDelete: models.Restrict,
+			OnChange: h.SaleOrderTemplateLine().Methods().OnchangeProduct()},
+		"Name": models.TextField{String: "Description",
+			Help: "If empty, the sales description of the product is used."},
+		"ProductUomQty": models.FloatField{String: "Quantity", Required: true,
+			Default: models.DefaultValue(1.0)},
+		"ProductUom":     models.Many2OneField{String: "Unit of Measure", RelationModel: h.ProductUom()},
+		"Discount":       models.FloatField{String: "Discount (%)"},
+		"LayoutCategory": models.Many2OneField{String: "Section", RelationModel: h.SaleLayoutCategory()},
+		"Optional": models.BooleanField{String: "Optional",
+			Help: "Optional lines are proposed to the customer but are not part of the quotation until they are added."},
+	})
+
+	h.SaleOrderTemplateLine().Methods().OnchangeProduct().DeclareMethod(
+		`OnchangeProduct sets the unit of measure of the product on this template line.`,
+		func(rs m.SaleOrderTemplateLineSet) m.SaleOrderTemplateLineData {
+			return h.SaleOrderTemplateLine().NewData().SetProductUom(rs.Product().Uom())
+		})
+
+	h.SaleOrder().AddFields(map[string]models.FieldDefinition{
+		"Template": models.Many2OneField{String: "Quotation Template", RelationModel: h.SaleOrderTemplate(),
+			Filter: q.SaleOrderTemplate().Active().Equals(true), ReadOnlyFunc: readOnlyUnlessQuotation,
+			OnChange: h.SaleOrder().Methods().OnchangeTemplate(),
+			Help:     "Lines of the template replace the lines of the quotation when the template is changed."},
+	})
+
+	h.SaleOrder().Methods().TemplateValues().DeclareMethod(
+		`TemplateValues returns the terms and conditions and the expiration date given by the template.`,
+		func(rs m.SaleOrderSet, template m.SaleOrderTemplateSet) m.SaleOrderData {
+			data := h.SaleOrder().NewData()
+			if template.IsEmpty() {
+				return data
+			}
+			if template.Note() != "" {
+				data.SetNote(template.Note())
+			}
+			if template.ValidityDays() > 0 {
+				data.SetValidityDate(dates.Today().AddDate(0, 0, template.ValidityDays()))
+			}
+			return data
+		})
+
+	h.SaleOrder().Methods().OnchangeTemplate().DeclareMethod(
+		`OnchangeTemplate updates the terms and conditions, the expiration date and the lines of
+		the quotation when the template is changed. The lines are built as if their products had been
+		selected in the user interface.
+
+		It must be called on the pseudo-record of the onchange, since the lines are built on it.`,
+		func(rs m.SaleOrderSet) m.SaleOrderData {
+			data := rs.TemplateValues(rs.Template())
+			if rs.Template().IsEmpty() {
+				return data
+			}
+			rs.CreateTemplateLines(rs.Template())
+			data.SetOrderLine(h.SaleOrderLine().NewSet(rs.Env()))
+			for _, line := range rs.OrderLine().Records() {
+				data.CreateOrderLine(h.SaleOrderLine().NewData().
+					SetSequence(line.Sequence()).
+					SetProduct(line.Product()).
+					SetName(line.Name()).
+					SetProductUomQty(line.ProductUomQty()).
+					SetProductUom(line.ProductUom()).
+					SetPriceUnit(line.PriceUnit()).
+					SetDiscount(line.Discount()).
+					SetTax(line.Tax()).
+					SetLayoutCategory(line.LayoutCategory()).
+					SetIsOptional(line.IsOptional()))
+			}
+			return data
+		})
+
+	h.SaleOrder().Methods().CreateTemplateLines().DeclareMethod(
+		`CreateTemplateLines replaces the lines of this quotation by the lines of the given template.
+		Prices and taxes of the new lines are computed as if the products had been selected
+		in the user interface.`,
+		func(rs m.SaleOrderSet, template m.SaleOrderTemplateSet) {
+			rs.EnsureOne()
+			if rs.OrderLine().IsNotEmpty() {
+				rs.OrderLine().Unlink()
+			}
+			for _, tmplLine := range template.Lines().Records() {
+				uom := tmplLine.ProductUom()
+				if uom.IsEmpty() {
+					uom = tmplLine.Product().Uom()
+				}
+				line := h.SaleOrderLine().Create(rs.Env(), h.SaleOrderLine().NewData().
+					SetOrder(rs).
+					SetSequence(tmplLine.Sequence()).
+					SetProduct(tmplLine.Product()).
+					SetName(tmplLine.Product().NameGet()).
+					SetProductUomQty(tmplLine.ProductUomQty()).
+					SetProductUom(uom).
+					SetDiscount(tmplLine.Discount()).
+					SetLayoutCategory(tmplLine.LayoutCategory()).
+					SetIsOptional(tmplLine.Optional()))
+				line.ApplyProductChange()
+				if tmplLine.Name() != "" {
+					line.SetName(tmplLine.Name())
+				}
+			}
+			if rs.GlobalDiscount() != 0 {
+				rs.ApplyGlobalDiscount()
+			}
+		})
+
+	h.SaleOrder().Methods().ApplyTemplate().DeclareMethod(
+		`ApplyTemplate applies the given template to the quotations of this RecordSet.
+		Their lines are replaced by the lines of the template, and their terms and conditions
+		and expiration date are set from the template, even if the template was already theirs.`,
+		func(rs m.SaleOrderSet, template m.SaleOrderTemplateSet) bool {
+			if template.IsEmpty() {
+				panic(rs.T("Please select a quotation template to apply."))
+			}
+			for _, order := range rs.Records() {
+				if order.State() != "draft" && order.State() != "sent" {
+					panic(rs.T("Templates can only be applied to quotations, but %s is not a quotation.", order.Name()))
+				}
+				if !order.Template().Equals(template) {
+					order.Write(h.SaleOrder().NewData().SetTemplate(template))
+					continue
+				}
+				order.Write(order.TemplateValues(template))
+				order.CreateTemplateLines(template)
+			}
+			return true
+		})
+
+	h.SaleOrder().Methods().Create().Extend("",
+		func(rs m.SaleOrderSet, data m.SaleOrderData) m.SaleOrderSet {
+			template := data.Template()
+			if template.IsEmpty() {
+				return rs.Super().Create(data)
+			}
+			values := rs.TemplateValues(template)
+			values.MergeWith(data)
+			order := rs.Super().Create(values)
+			if order.OrderLine().IsEmpty() {
+				order.CreateTemplateLines(template)
+			}
+			return order
+		})
+
+	h.SaleOrder().Methods().Write().Extend("",
+		func(rs m.SaleOrderSet, data m.SaleOrderData) bool {
+			template := data.Template()
+			if template.IsEmpty() {
+				return rs.Super().Write(data)
+			}
+			changed := rs.Filtered(func(r m.SaleOrderSet) bool { return !r.Template().Equals(template) })
+			if changed.IsEmpty() {
+				return rs.Super().Write(data)
+			}
+			for _, order := range changed.Records() {
+				if order.State() != "draft" && order.State() != "sent" {
+					panic(rs.T("Templates can only be applied to quotations, but %s is not a quotation.", order.Name()))
+				}
+			}
+			res := rs.Super().Write(data)
+			values := rs.TemplateValues(template)
+			if data.HasNote() {
+				values.UnsetNote()
+			}
+			if data.HasValidityDate() {
+				values.UnsetValidityDate()
+			}
+			changed.Write(values)
+			if !data.HasOrderLine() {
+				// The lines have not been built by the onchange of the template
+				for _, order := range changed.Records() {
+					order.CreateTemplateLines(template)
+				}
+			}
+			return res
+		})
+
+}
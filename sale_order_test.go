@@ -4,17 +4,36 @@
 package sale
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 
+	"github.com/hexya-addons/sale/saletypes"
 	"github.com/hexya-addons/saleTeams"
+	"github.com/hexya-erp/hexya/src/actions"
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
 	"github.com/hexya-erp/pool/h"
 	"github.com/hexya-erp/pool/m"
 	"github.com/hexya-erp/pool/q"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
+// testMailTransport records the messages it sends or fails with err if set.
+type testMailTransport struct {
+	err  error
+	sent []saletypes.MailMessage
+}
+
+func (tmt *testMailTransport) Send(msg saletypes.MailMessage) error {
+	if tmt.err != nil {
+		return tmt.err
+	}
+	tmt.sent = append(tmt.sent, msg)
+	return nil
+}
+
 type saleOrderTestData struct {
 	Manager         m.UserSet
 	User            m.UserSet
@@ -23,6 +42,7 @@ type saleOrderTestData struct {
 	ServiceOrder    m.ProductProductSet
 	ServiceDelivery m.ProductProductSet
 	Partner         m.PartnerSet
+	Pricelist       m.ProductPricelistSet
 	SaleJournal     m.AccountJournalSet
 }
 
@@ -51,6 +71,7 @@ func initTestSaleOrder(env models.Environment) *saleOrderTestData {
 	res.ServiceOrder = h.ProductProduct().NewSet(env).GetRecord("product_service_order_01")
 	res.ServiceDelivery = h.ProductProduct().NewSet(env).GetRecord("product_service_delivery")
 	res.Partner = h.Partner().NewSet(env).GetRecord("base_res_partner_1")
+	res.Pricelist = h.ProductPricelist().NewSet(env).GetRecord("product_list0")
 	res.SaleJournal = h.AccountJournal().Create(env, h.AccountJournal().NewData().
 		SetName("Sale's journal").
 		SetType("sale").
@@ -58,6 +79,29 @@ func initTestSaleOrder(env models.Environment) *saleOrderTestData {
 	return &res
 }
 
+// orderData returns the data of a quotation without lines for the test partner.
+func (tsd *saleOrderTestData) orderData() m.SaleOrderData {
+	return h.SaleOrder().NewData().
+		SetPartner(tsd.Partner).
+		SetPricelist(tsd.Pricelist)
+}
+
+// lineData returns the data of an order line of qty units of the given product at the given unit price.
+func (tsd *saleOrderTestData) lineData(product m.ProductProductSet, qty, priceUnit float64) m.SaleOrderLineData {
+	return h.SaleOrderLine().NewData().
+		SetName(product.Name()).
+		SetProduct(product).
+		SetProductUomQty(qty).
+		SetProductUom(product.Uom()).
+		SetPriceUnit(priceUnit)
+}
+
+// quotationData returns the data of a quotation for the test partner with
+// a single line of qty units of the stockable product at the given unit price.
+func (tsd *saleOrderTestData) quotationData(qty, priceUnit float64) m.SaleOrderData {
+	return tsd.orderData().CreateOrderLine(tsd.lineData(tsd.ProductOrder, qty, priceUnit))
+}
+
 func TestSaleOrder(t *testing.T) {
 	Convey("Testing sale orders", t, func() {
 		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
@@ -134,7 +178,8 @@ func TestSaleOrder(t *testing.T) {
 				soCopy = so.Copy(nil)
 				soCopy.ActionConfirm()
 				So(soCopy.State(), ShouldEqual, "sale")
-				soCopy.ActionCancel()
+				So(func() { soCopy.ActionCancel() }, ShouldPanic)
+				soCopy.CancelWithReason(h.SaleCancelReason().NewSet(env).GetRecord("sale_cancel_reason_other"), false)
 				So(soCopy.State(), ShouldEqual, "cancel")
 				So(func() { soCopy.Sudo(tsd.User.ID()).Unlink() }, ShouldPanic)
 				So(func() { soCopy.Sudo(tsd.Manager.ID()).Unlink() }, ShouldNotPanic)
@@ -208,6 +253,693 @@ func TestSaleOrder(t *testing.T) {
 				So(sol.ProductUomQty(), ShouldEqual, 0)
 				So(sol.QtyInvoiced(), ShouldEqual, 0)
 			})
+			Convey("Test printing a quotation", func() {
+				so := h.SaleOrder().Create(env, tsd.orderData().
+					SetPartnerInvoice(tsd.Partner).
+					SetPartnerShipping(tsd.Partner).
+					SetNote("Payment within 30 days").
+					CreateOrderLine(h.SaleOrderLine().NewData().
+						SetName("Printed product line").
+						SetProduct(tsd.ProductOrder).
+						SetProductUomQty(2).
+						SetProductUom(tsd.ProductOrder.Uom()).
+						SetPriceUnit(tsd.ProductOrder.ListPrice())))
+				action := so.PrintQuotation()
+				So(so.State(), ShouldEqual, "sent")
+				So(action.Type, ShouldEqual, actions.ActionClient)
+				So(action.Context.GetString("report_url"), ShouldEqual, fmt.Sprintf("%s%d", ReportSaleOrderURL, so.ID()))
+				report := string(so.RenderHTML())
+				So(report, ShouldContainSubstring, so.Name())
+				So(report, ShouldContainSubstring, "Printed product line")
+				So(report, ShouldContainSubstring, "Payment within 30 days")
+			})
+			Convey("Test sending a quotation by e-mail", func() {
+				so := h.SaleOrder().Create(env, tsd.orderData().
+					SetPartnerInvoice(tsd.Partner).
+					SetPartnerShipping(tsd.Partner).
+					CreateOrderLine(tsd.lineData(tsd.ProductOrder, 2, tsd.ProductOrder.ListPrice())))
+				transport := &testMailTransport{err: errors.New("connection refused")}
+				defaultTransport := MailTransport
+				MailTransport = transport
+				defer func() { MailTransport = defaultTransport }()
+
+				so.ForceQuotationSend()
+				saleMail := h.SaleMail().Search(env, q.SaleMail().Order().Equals(so))
+				So(saleMail.Len(), ShouldEqual, 1)
+				So(saleMail.State(), ShouldEqual, "exception")
+				So(saleMail.FailureReason(), ShouldEqual, "connection refused")
+				So(so.State(), ShouldEqual, "draft")
+
+				transport.err = nil
+				So(MailQueueInterval, ShouldBeGreaterThan, 0)
+				runScheduledJob(env, "sale_process_mail_queue")
+				So(saleMail.State(), ShouldEqual, "sent")
+				So(so.State(), ShouldEqual, "sent")
+				So(transport.sent, ShouldHaveLength, 1)
+				So(transport.sent[0].To, ShouldResemble, []string{tsd.Partner.EmailFormatted()})
+				So(transport.sent[0].Body, ShouldContainSubstring, so.Name())
+				So(transport.sent[0].Attachments, ShouldHaveLength, 1)
+
+				action := so.ActionQuotationSend()
+				draft := h.SaleMail().Browse(env, []int64{action.ResID})
+				So(draft.State(), ShouldEqual, "draft")
+				So(draft.ProcessQueue(), ShouldBeTrue)
+				So(draft.State(), ShouldEqual, "draft")
+				So(transport.sent, ShouldHaveLength, 1)
+				draft.ActionSend()
+				So(draft.State(), ShouldEqual, "sent")
+				So(transport.sent, ShouldHaveLength, 2)
+
+				discarded := h.SaleMail().Browse(env, []int64{so.ActionQuotationSend().ResID})
+				attachment := discarded.Attachments()
+				So(attachment.Len(), ShouldEqual, 1)
+				discarded.Unlink()
+				So(h.Attachment().Search(env, q.Attachment().ID().Equals(attachment.ID())).IsEmpty(), ShouldBeTrue)
+				So(draft.Attachments().IsNotEmpty(), ShouldBeTrue)
+
+				so.WithContext("send_email", true).ActionConfirm()
+				confirmation := h.SaleMail().Search(env, q.SaleMail().Order().Equals(so).And().Kind().Equals("confirmation"))
+				So(confirmation.Len(), ShouldEqual, 1)
+				So(confirmation.State(), ShouldEqual, "sent")
+
+				noEmail := h.SaleOrder().Create(env, h.SaleOrder().NewData().
+					SetPartner(h.Partner().Create(env, h.Partner().NewData().SetName("No E-mail"))).
+					SetPricelist(tsd.Pricelist))
+				So(func() { noEmail.ActionQuotationSend() }, ShouldPanic)
+				So(noEmail.WithContext("send_email", true).ActionConfirm(), ShouldBeTrue)
+				So(noEmail.State(), ShouldEqual, "sale")
+			})
+			Convey("Test the layout of order and invoice lines", func() {
+				hardware := h.SaleLayoutCategory().Create(env, h.SaleLayoutCategory().NewData().
+					SetName("Hardware").
+					SetSequence(1).
+					SetPagebreak(true))
+				services := h.SaleLayoutCategory().Create(env, h.SaleLayoutCategory().NewData().
+					SetName("Services").
+					SetSequence(2).
+					SetSubtotal(false))
+				layoutLine := func(product m.ProductProductSet, sequence int64, category m.SaleLayoutCategorySet) m.SaleOrderLineData {
+					return tsd.lineData(product, 1, 100).
+						SetSequence(sequence).
+						SetLayoutCategory(category)
+				}
+				so := h.SaleOrder().Create(env, tsd.orderData().
+					CreateOrderLine(layoutLine(tsd.ProductOrder, 1, hardware)).
+					CreateOrderLine(layoutLine(tsd.ProductDelivery, 2, hardware)).
+					CreateOrderLine(layoutLine(tsd.ServiceDelivery, 3, services)).
+					CreateOrderLine(layoutLine(tsd.ServiceOrder, 4, h.SaleLayoutCategory().NewSet(env))))
+				pages := so.OrderLinesLayouted()
+				So(pages, ShouldHaveLength, 2)
+				So(pages[0], ShouldHaveLength, 1)
+				So(pages[0][0].Name, ShouldEqual, "Hardware")
+				So(pages[0][0].Pagebreak, ShouldBeTrue)
+				So(pages[0][0].Subtotal, ShouldBeTrue)
+				So(pages[0][0].Default, ShouldBeFalse)
+				So(pages[0][0].SubtotalAmount, ShouldEqual, 200)
+				hardwareLines := so.LayoutSectionLines(pages[0][0])
+				So(hardwareLines.Len(), ShouldEqual, 2)
+				So(hardwareLines.Records()[0].Product().Equals(tsd.ProductOrder), ShouldBeTrue)
+				So(hardwareLines.Records()[1].Product().Equals(tsd.ProductDelivery), ShouldBeTrue)
+				So(pages[1], ShouldHaveLength, 2)
+				So(pages[1][0].Name, ShouldEqual, "Services")
+				So(pages[1][0].Subtotal, ShouldBeFalse)
+				So(pages[1][1].Default, ShouldBeTrue)
+				So(so.LayoutSectionLines(pages[1][1]).Product().Equals(tsd.ServiceOrder), ShouldBeTrue)
+
+				so.ActionConfirm()
+				inv := so.ActionInvoiceCreate(false, false)
+				invPages := inv.OrderLinesLayouted()
+				So(invPages, ShouldHaveLength, 2)
+				So(invPages[0][0].Name, ShouldEqual, "Hardware")
+				So(inv.LayoutSectionLines(invPages[0][0]).Product().Equals(tsd.ProductOrder), ShouldBeTrue)
+				So(invPages[1], ShouldHaveLength, 1)
+				So(invPages[1][0].Default, ShouldBeTrue)
+				So(inv.LayoutSectionLines(invPages[1][0]).Product().Equals(tsd.ServiceOrder), ShouldBeTrue)
+			})
+			Convey("Test the history of the changes of an order", func() {
+				so := h.SaleOrder().Create(env, tsd.quotationData(5, 100))
+				So(so.ChangeLogs().IsEmpty(), ShouldBeTrue)
+				line := so.OrderLine()
+				line.SetPriceUnit(80)
+				line.SetDiscount(10)
+				so.SetUser(tsd.Manager)
+				so.ActionConfirm()
+				line.SetProductUomQty(3)
+
+				logs := so.ChangeLogs()
+				So(logs.Len(), ShouldEqual, 5)
+				for _, kind := range []string{"price", "discount", "salesperson", "state", "quantity"} {
+					So(logs.Search(q.SaleOrderLog().Kind().Equals(kind)).Len(), ShouldEqual, 1)
+				}
+				stateLog := logs.Search(q.SaleOrderLog().Kind().Equals("state"))
+				So(stateLog.OldValue(), ShouldEqual, "draft")
+				So(stateLog.NewValue(), ShouldEqual, "sale")
+				So(stateLog.User().Equals(h.User().NewSet(env).CurrentUser()), ShouldBeTrue)
+				qtyLog := logs.Search(q.SaleOrderLog().Kind().Equals("quantity"))
+				So(qtyLog.OrderLine().Equals(line), ShouldBeTrue)
+				So(qtyLog.Message(), ShouldContainSubstring, "decreased")
+				So(qtyLog.Message(), ShouldContainSubstring, "5 -> 3")
+			})
+			Convey("Test the expiry of quotations", func() {
+				so := h.SaleOrder().Create(env, tsd.orderData())
+				validity := dates.Today().AddDate(0, 0, so.Company().QuotationValidityDays())
+				So(so.ValidityDate().Equal(validity), ShouldBeTrue)
+				So(so.IsExpired(), ShouldBeFalse)
+
+				so.SetValidityDate(dates.Today().AddDate(0, 0, -1))
+				So(so.IsExpired(), ShouldBeTrue)
+				So(h.SaleOrder().NewSet(env).ExpireQuotations().IsNotEmpty(), ShouldBeTrue)
+				So(so.State(), ShouldEqual, "expired")
+				stateLog := so.ChangeLogs().Search(q.SaleOrderLog().Kind().Equals("state"))
+				So(stateLog.Message(), ShouldContainSubstring, "expired")
+
+				so.ActionDraft()
+				So(so.State(), ShouldEqual, "draft")
+				So(so.ValidityDate().Equal(validity), ShouldBeTrue)
+
+				// A quotation that cannot be cancelled does not prevent the others from expiring
+				blocked := h.SaleOrder().Create(env, tsd.quotationData(2, 100))
+				blocked.ActionConfirm()
+				blocked.ActionInvoiceCreate(false, false).InvoiceValidate()
+				blocked.SetState("sent")
+				blocked.SetValidityDate(dates.Today().AddDate(0, 0, -1))
+
+				h.ConfigParameter().NewSet(env).SetParam("sale.expired_quotation_policy", "cancel")
+				so.SetValidityDate(dates.Today().AddDate(0, 0, -1))
+				So(QuotationExpiryInterval, ShouldBeGreaterThan, 0)
+				runScheduledJob(env, "sale_expire_quotations")
+				So(so.State(), ShouldEqual, "cancel")
+				So(blocked.State(), ShouldEqual, "sent")
+			})
+			Convey("Test the credit limit of customers", func() {
+				customer := h.Partner().Create(env, h.Partner().NewData().
+					SetName("Limited Customer").
+					SetIsCompany(true).
+					SetCreditLimit(150))
+				contact := h.Partner().Create(env, h.Partner().NewData().
+					SetName("Limited Contact").
+					SetParent(customer))
+				so := h.SaleOrder().Create(env, tsd.quotationData(2, 100).SetPartner(contact))
+				So(func() { so.ActionConfirm() }, ShouldPanic)
+				So(so.State(), ShouldEqual, "draft")
+
+				customer.SetCreditLimit(1000)
+				so.ActionConfirm()
+				So(so.State(), ShouldEqual, "sale")
+				So(contact.SaleCreditExposure(), ShouldEqual, so.AmountTotal())
+
+				// Orders in another currency are converted to the currency of the company
+				otherCurrency := h.Currency().Create(env, h.Currency().NewData().
+					SetName("OTH").
+					SetSymbol("oth"))
+				h.CurrencyRate().Create(env, h.CurrencyRate().NewData().
+					SetName(dates.Now().AddDate(0, 0, -1)).
+					SetRate(2).
+					SetCurrency(otherCurrency).
+					SetCompany(h.User().NewSet(env).CurrentUser().Company()))
+				otherPricelist := h.ProductPricelist().Create(env, h.ProductPricelist().NewData().
+					SetName("Other currency pricelist").
+					SetCurrency(otherCurrency))
+				customer.SetCreditLimit(so.AmountTotal() * 2)
+				otherSo := h.SaleOrder().Create(env, h.SaleOrder().NewData().
+					SetPartner(contact).
+					SetPricelist(otherPricelist).
+					CreateOrderLine(tsd.lineData(tsd.ProductOrder, 3, 100)))
+				So(otherSo.AmountTotal(), ShouldBeGreaterThan, so.AmountTotal())
+				otherSo.ActionConfirm()
+				So(otherSo.State(), ShouldEqual, "sale")
+				So(contact.SaleCreditExposure(), ShouldAlmostEqual, so.AmountTotal()+otherSo.AmountTotal()/2, 0.01)
+
+				// Orders exceeding the limit are sent for approval to a sales manager
+				h.ConfigParameter().NewSet(env).SetParam("sale.credit_limit_policy", "approval")
+				approvalSo := h.SaleOrder().Create(env, tsd.quotationData(2, 100).SetPartner(contact))
+				approvalSo.Sudo(tsd.User.ID()).ActionConfirm()
+				So(approvalSo.State(), ShouldEqual, "to_approve")
+				So(approvalSo.Approvals().Level(), ShouldEqual, "manager")
+				So(approvalSo.Approvals().State(), ShouldEqual, "pending")
+				So(func() { approvalSo.Sudo(tsd.User.ID()).ActionConfirm() }, ShouldPanic)
+				So(approvalSo.Approvals().Len(), ShouldEqual, 1)
+				approvalSo.Sudo(tsd.Manager.ID()).ActionApprove()
+				So(approvalSo.State(), ShouldEqual, "draft")
+				approvalSo.Sudo(tsd.User.ID()).ActionConfirm()
+				So(approvalSo.State(), ShouldEqual, "sale")
+			})
+			Convey("Test the approval of quotations", func() {
+				h.SaleApprovalRule().Create(env, h.SaleApprovalRule().NewData().
+					SetName("Big quotations").
+					SetMinAmount(1000).
+					SetLevel("manager"))
+				so := h.SaleOrder().Create(env, tsd.quotationData(20, 100))
+				so.ActionConfirm()
+				So(so.State(), ShouldEqual, "to_approve")
+				So(so.Approvals().Len(), ShouldEqual, 1)
+				So(so.Approvals().State(), ShouldEqual, "pending")
+				So(func() { so.ActionConfirm() }, ShouldPanic)
+
+				so.ActionApprove()
+				So(so.State(), ShouldEqual, "draft")
+				So(so.Approvals().State(), ShouldEqual, "approved")
+				So(so.Approvals().User().Equals(h.User().NewSet(env).CurrentUser()), ShouldBeTrue)
+				So(so.Approvals().Date().IsZero(), ShouldBeFalse)
+				So(so.Approvals().AmountTotal(), ShouldAlmostEqual, so.AmountTotal())
+				So(so.Approvals().IsCurrent(), ShouldBeTrue)
+
+				approval := so.Approvals()
+				so.OrderLine().SetProductUomQty(30)
+				So(approval.IsCurrent(), ShouldBeFalse)
+				so.ActionConfirm()
+				So(so.State(), ShouldEqual, "to_approve")
+				So(approval.State(), ShouldEqual, "void")
+				So(so.PendingApproval().IsNotEmpty(), ShouldBeTrue)
+				So(so.PendingApproval().Equals(approval), ShouldBeFalse)
+
+				so.ActionApprove()
+				So(so.State(), ShouldEqual, "draft")
+				so.ActionConfirm()
+				So(so.State(), ShouldEqual, "sale")
+			})
+			Convey("Test the revisions of quotations", func() {
+				so := h.SaleOrder().Create(env, tsd.quotationData(2, 100))
+				name := so.Name()
+				so.ActionNewRevision()
+				So(so.Name(), ShouldEqual, name+"-R2")
+				So(so.State(), ShouldEqual, "draft")
+				So(so.OldRevisions().Len(), ShouldEqual, 1)
+				oldRevision := so.OldRevisions()
+				So(oldRevision.Name(), ShouldEqual, name)
+				So(oldRevision.OrderLine().Len(), ShouldEqual, 1)
+				So(oldRevision.State(), ShouldEqual, "revised")
+				So(oldRevision.CancelReason().IsEmpty(), ShouldBeTrue)
+				So(h.SaleOrder().Search(env, q.SaleOrder().State().Equals("cancel").
+					And().UnrevisedName().Equals(name)).IsEmpty(), ShouldBeTrue)
+				So(func() { oldRevision.SetNote("Changed") }, ShouldPanic)
+				So(func() { oldRevision.OrderLine().SetProductUomQty(3) }, ShouldPanic)
+
+				so.OrderLine().SetProductUomQty(5)
+				diff := oldRevision.DiffRevision(so)
+				So(diff, ShouldHaveLength, 1)
+				So(diff[0].Change, ShouldEqual, "changed")
+				So(diff[0].OldQuantity, ShouldEqual, 2)
+				So(diff[0].NewQuantity, ShouldEqual, 5)
+
+				so.ActionNewRevision()
+				So(so.Name(), ShouldEqual, name+"-R3")
+				So(so.OldRevisions().Len(), ShouldEqual, 2)
+			})
+			Convey("Test cancelling orders with invoices and procurements", func() {
+				reason := h.SaleCancelReason().NewSet(env).GetRecord("sale_cancel_reason_price")
+				soData := tsd.quotationData(2, 100)
+				so := h.SaleOrder().Create(env, soData)
+				so.ActionConfirm()
+				procurements := so.OrderLine().Procurements()
+				inv := so.ActionInvoiceCreate(false, false)
+				So(inv.State(), ShouldEqual, "draft")
+
+				so.CancelWithReason(reason, false)
+				So(so.State(), ShouldEqual, "cancel")
+				So(so.CancelReason().Equals(reason), ShouldBeTrue)
+				So(inv.State(), ShouldEqual, "cancel")
+				for _, procurement := range procurements.Records() {
+					So(procurement.State(), ShouldEqual, "cancel")
+				}
+
+				so = h.SaleOrder().Create(env, soData)
+				so.ActionConfirm()
+				inv = so.ActionInvoiceCreate(false, false)
+				inv.InvoiceValidate()
+				So(func() { so.CancelWithReason(reason, false) }, ShouldPanic)
+				So(so.State(), ShouldEqual, "sale")
+				So(so.CancelReason().IsEmpty(), ShouldBeTrue)
+				draftRefund := inv.Refund(dates.Today(), dates.Today(), "Wrong price", h.AccountJournal().NewSet(env))
+				So(draftRefund.State(), ShouldEqual, "draft")
+				So(so.PostedInvoicesWithoutRefund().Equals(inv), ShouldBeTrue)
+				So(func() { so.CancelWithReason(reason, false) }, ShouldPanic)
+				so.CancelWithReason(reason, true)
+				So(so.State(), ShouldEqual, "cancel")
+				So(so.CancelReason().Equals(reason), ShouldBeTrue)
+				refunds := h.AccountInvoice().Search(env, q.AccountInvoice().RefundInvoice().Equals(inv))
+				So(refunds.Len(), ShouldEqual, 1)
+				So(refunds.State(), ShouldEqual, "open")
+				So(so.PostedInvoicesWithoutRefund().IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Test unlocking locked orders", func() {
+				so := h.SaleOrder().Create(env, tsd.quotationData(2, 100))
+				so.ActionConfirm()
+				so.ActionDone()
+				So(so.State(), ShouldEqual, "done")
+				So(func() { so.Sudo(tsd.User.ID()).ActionUnlock() }, ShouldPanic)
+				So(so.State(), ShouldEqual, "done")
+				so.Sudo(tsd.Manager.ID()).ActionUnlock()
+				So(so.State(), ShouldEqual, "sale")
+				unlockLog := so.ChangeLogs().Filtered(func(r m.SaleOrderLogSet) bool {
+					return r.Kind() == "state" && r.OldValue() == "done"
+				})
+				So(unlockLog.Len(), ShouldEqual, 1)
+				So(unlockLog.User().Equals(tsd.Manager), ShouldBeTrue)
+				So(unlockLog.NewValue(), ShouldEqual, "sale")
+			})
+			Convey("Test the read only fields of confirmed and locked orders", func() {
+				other := h.Partner().Create(env, h.Partner().NewData().SetName("Other Customer"))
+				so := h.SaleOrder().Create(env, tsd.quotationData(2, 100))
+				so.ActionConfirm()
+				So(func() { so.SetPartner(other) }, ShouldPanic)
+				So(func() { so.SetPartnerInvoice(other) }, ShouldPanic)
+				So(so.Partner().Equals(tsd.Partner), ShouldBeTrue)
+				So(func() { so.SetPartner(tsd.Partner) }, ShouldNotPanic)
+				So(func() { so.SetNote("Deliver in the morning") }, ShouldNotPanic)
+				So(func() { so.OrderLine().SetPriceUnit(90) }, ShouldNotPanic)
+
+				so.ActionDone()
+				So(func() { so.OrderLine().SetPriceUnit(80) }, ShouldPanic)
+				So(so.OrderLine().PriceUnit(), ShouldEqual, 90)
+				So(func() {
+					h.SaleOrderLine().Create(env, h.SaleOrderLine().NewData().
+						SetOrder(so).
+						SetName(tsd.ProductOrder.Name()).
+						SetProduct(tsd.ProductOrder).
+						SetProductUomQty(1).
+						SetProductUom(tsd.ProductOrder.Uom()))
+				}, ShouldPanic)
+			})
+			Convey("Test quotation templates", func() {
+				tsd.ProductOrder.SetListPrice(100)
+				template := h.SaleOrderTemplate().Create(env, h.SaleOrderTemplate().NewData().
+					SetName("Standard Offer").
+					SetValidityDays(15).
+					SetNote("Prices valid for the whole offer only").
+					CreateLines(h.SaleOrderTemplateLine().NewData().
+						SetProduct(tsd.ProductOrder).
+						SetProductUomQty(3).
+						SetDiscount(10)).
+					CreateLines(h.SaleOrderTemplateLine().NewData().
+						SetProduct(tsd.ServiceOrder).
+						SetOptional(true)))
+				so := h.SaleOrder().Create(env, tsd.orderData().
+					SetTemplate(template))
+				So(so.OrderLine().Len(), ShouldEqual, 2)
+				So(so.OptionalLines().Product().Equals(tsd.ServiceOrder), ShouldBeTrue)
+				So(so.OrderLine().Product().Equals(tsd.ProductOrder), ShouldBeTrue)
+				So(so.OrderLine().ProductUomQty(), ShouldEqual, 3)
+				So(so.OrderLine().Discount(), ShouldEqual, 10)
+				So(so.OrderLine().PriceUnit(), ShouldEqual, 100)
+				So(so.AmountUntaxed(), ShouldEqual, 270)
+				So(so.Note(), ShouldEqual, "Prices valid for the whole offer only")
+				So(so.ValidityDate().Equal(dates.Today().AddDate(0, 0, 15)), ShouldBeTrue)
+
+				onchange := so.OnchangeTemplate()
+				So(onchange.HasOrderLine(), ShouldBeTrue)
+				So(onchange.OrderLine().IsEmpty(), ShouldBeTrue)
+				linesData := onchange.Underlying().ToCreate["order_line"]
+				So(linesData, ShouldHaveLength, 2)
+				So(linesData[0].Get("PriceUnit"), ShouldEqual, 100)
+				So(linesData[0].Get("Discount"), ShouldEqual, 10)
+				So(linesData[0].Get("ProductUomQty"), ShouldEqual, 3)
+
+				so.OrderLine().Filtered(func(r m.SaleOrderLineSet) bool { return !r.IsOptional() }).SetProductUomQty(5)
+				so.Write(h.SaleOrder().NewData().SetTemplate(template).SetNote("Special terms"))
+				So(so.AmountUntaxed(), ShouldEqual, 450)
+				So(so.Note(), ShouldEqual, "Special terms")
+
+				other := h.SaleOrder().Create(env, tsd.orderData().
+					CreateOrderLine(tsd.lineData(tsd.ServiceDelivery, 1, 50)))
+				other.ApplyTemplate(template)
+				So(other.Template().Equals(template), ShouldBeTrue)
+				So(other.OrderLine().Len(), ShouldEqual, 2)
+				So(other.OrderLine().Product().Equals(tsd.ProductOrder), ShouldBeTrue)
+
+				other.ActionConfirm()
+				So(func() { other.ApplyTemplate(template) }, ShouldPanic)
+				other.Write(h.SaleOrder().NewData().SetTemplate(template).SetClientOrderRef("PO-42"))
+				So(other.ClientOrderRef(), ShouldEqual, "PO-42")
+				So(other.OrderLine().Len(), ShouldEqual, 2)
+			})
+			Convey("Test optional lines", func() {
+				tsd.ProductOrder.ProductTmpl().SetOptionalProducts(tsd.ServiceOrder.ProductTmpl())
+				so := h.SaleOrder().Create(env, tsd.quotationData(2, 100))
+				amountTotal := so.AmountTotal()
+				So(so.SuggestedOptionalProducts().Equals(tsd.ServiceOrder), ShouldBeTrue)
+				so.ActionAddSuggestedOptionals()
+				optional := so.OptionalLines()
+				So(optional.Len(), ShouldEqual, 1)
+				So(optional.Product().Equals(tsd.ServiceOrder), ShouldBeTrue)
+				So(optional.PriceUnit(), ShouldEqual, tsd.ServiceOrder.ListPrice())
+				So(so.AmountTotal(), ShouldEqual, amountTotal)
+				So(so.SuggestedOptionalProducts().IsEmpty(), ShouldBeTrue)
+
+				so.ActionConfirm()
+				So(optional.QtyToInvoice(), ShouldEqual, 0)
+				So(optional.Procurements().IsEmpty(), ShouldBeTrue)
+				So(func() { so.OrderLine().Subtract(optional).SetIsOptional(true) }, ShouldPanic)
+				inv := so.ActionInvoiceCreate(false, false)
+				So(inv.InvoiceLines().Len(), ShouldEqual, 1)
+				So(inv.InvoiceLines().Product().Equals(tsd.ProductOrder), ShouldBeTrue)
+
+				optional.ActionAddOptional()
+				So(so.OptionalLines().IsEmpty(), ShouldBeTrue)
+				So(so.AmountTotal(), ShouldBeGreaterThan, amountTotal)
+				So(optional.QtyToInvoice(), ShouldEqual, 1)
+				inv = so.ActionInvoiceCreate(false, false)
+				So(inv.InvoiceLines().Product().Equals(tsd.ServiceOrder), ShouldBeTrue)
+			})
+			Convey("Test global discounts", func() {
+				group10 := h.AccountTaxGroup().Create(env, h.AccountTaxGroup().NewData().SetName("VAT 10%"))
+				group20 := h.AccountTaxGroup().Create(env, h.AccountTaxGroup().NewData().SetName("VAT 20%"))
+				tax10 := h.AccountTax().Create(env, h.AccountTax().NewData().
+					SetName("Tax 10%").
+					SetAmount(10).
+					SetTypeTaxUse("sale").
+					SetTaxGroup(group10))
+				tax20 := h.AccountTax().Create(env, h.AccountTax().NewData().
+					SetName("Tax 20%").
+					SetAmount(20).
+					SetTypeTaxUse("sale").
+					SetTaxGroup(group20))
+				so := h.SaleOrder().Create(env, tsd.orderData().
+					SetGlobalDiscountMethod("line").
+					CreateOrderLine(tsd.lineData(tsd.ProductOrder, 2, 100).
+						SetTax(tax10)).
+					CreateOrderLine(tsd.lineData(tsd.ServiceOrder, 1, 200).
+						SetTax(tax20)))
+				So(so.AmountUntaxed(), ShouldEqual, 400)
+				So(so.AmountTax(), ShouldAlmostEqual, 60)
+				taxAmounts := func() map[string]float64 {
+					res := make(map[string]float64)
+					for _, group := range so.GetTaxAmountByGroup() {
+						res[group.GroupName] = group.TaxAmount
+					}
+					return res
+				}
+
+				so.SetGlobalDiscount(10)
+				So(so.DiscountLines().Len(), ShouldEqual, 2)
+				So(so.AmountUntaxed(), ShouldAlmostEqual, 360)
+				So(so.AmountTax(), ShouldAlmostEqual, 54)
+				So(taxAmounts()["VAT 10%"], ShouldAlmostEqual, 18)
+				So(taxAmounts()["VAT 20%"], ShouldAlmostEqual, 36)
+				so.ApplyGlobalDiscount()
+				So(so.DiscountLines().Len(), ShouldEqual, 2)
+				So(so.AmountUntaxed(), ShouldAlmostEqual, 360)
+
+				so.SetGlobalDiscountMethod("spread")
+				So(so.DiscountLines().IsEmpty(), ShouldBeTrue)
+				So(so.OrderLine().Discount(), ShouldAlmostEqual, 10)
+				So(so.AmountUntaxed(), ShouldAlmostEqual, 360)
+				So(taxAmounts()["VAT 20%"], ShouldAlmostEqual, 36)
+
+				so.Write(h.SaleOrder().NewData().
+					SetGlobalDiscountType("fixed").
+					SetGlobalDiscount(100))
+				So(so.AmountUntaxed(), ShouldAlmostEqual, 300)
+				so.SetGlobalDiscount(0)
+				So(so.OrderLine().Discount(), ShouldEqual, 0)
+				So(so.AmountUntaxed(), ShouldEqual, 400)
+
+				so.Write(h.SaleOrder().NewData().
+					SetGlobalDiscountMethod("line").
+					SetGlobalDiscountType("percent").
+					SetGlobalDiscount(10))
+				serviceLine := so.OrderLine().Filtered(func(r m.SaleOrderLineSet) bool { return r.Product().Equals(tsd.ServiceOrder) })
+				serviceLine.SetProductUomQty(2)
+				So(so.AmountUntaxed(), ShouldAlmostEqual, 540)
+				serviceLine.SetProductUomQty(1)
+				So(so.AmountUntaxed(), ShouldAlmostEqual, 360)
+				extraLine := h.SaleOrderLine().Create(env, h.SaleOrderLine().NewData().
+					SetOrder(so).
+					SetName(tsd.ServiceDelivery.Name()).
+					SetProduct(tsd.ServiceDelivery).
+					SetProductUomQty(1).
+					SetProductUom(tsd.ServiceDelivery.Uom()).
+					SetPriceUnit(100).
+					SetTax(tax10))
+				So(so.AmountUntaxed(), ShouldAlmostEqual, 450)
+				extraLine.Unlink()
+				So(so.AmountUntaxed(), ShouldAlmostEqual, 360)
+
+				// Changes made without updating the global discount are caught up at confirmation
+				serviceLine.WithContext("sale_global_discount", true).SetProductUomQty(2)
+				So(so.AmountUntaxed(), ShouldAlmostEqual, 560)
+				so.ActionConfirm()
+				So(so.AmountUntaxed(), ShouldAlmostEqual, 540)
+				inv := so.ActionInvoiceCreate(false, false)
+				So(inv.InvoiceLines().Len(), ShouldEqual, 4)
+				So(inv.AmountUntaxed(), ShouldAlmostEqual, 540)
+				So(inv.AmountTax(), ShouldAlmostEqual, 90)
+			})
+			Convey("Test promotions and coupons", func() {
+				h.SalePromotion().Create(env, h.SalePromotion().NewData().
+					SetName("Free delivery").
+					SetMinAmount(300).
+					SetRewardType("product").
+					SetRewardProduct(tsd.ServiceDelivery))
+				h.SalePromotion().Create(env, h.SalePromotion().NewData().
+					SetName("Half price").
+					SetRewardType("discount_percent").
+					SetDiscountPercent(50).
+					SetDiscountApplyOn("cheapest"))
+				couponPromotion := h.SalePromotion().Create(env, h.SalePromotion().NewData().
+					SetName("Welcome").
+					SetNeedCoupon(true).
+					SetRewardType("discount_fixed").
+					SetDiscountFixed(40))
+				coupon := couponPromotion.GenerateCoupons(1)
+				So(coupon.State(), ShouldEqual, "new")
+				newOrder := func() m.SaleOrderSet {
+					return h.SaleOrder().Create(env, tsd.quotationData(2, 100).
+						CreateOrderLine(tsd.lineData(tsd.ServiceOrder, 1, 200)))
+				}
+				so := newOrder()
+				So(so.ApplyPromotions(), ShouldBeTrue)
+				So(so.RewardLines().Len(), ShouldEqual, 2)
+				So(so.AmountUntaxed(), ShouldAlmostEqual, 350)
+				so.ApplyPromotions()
+				So(so.RewardLines().Len(), ShouldEqual, 2)
+				So(so.AmountUntaxed(), ShouldAlmostEqual, 350)
+
+				So(so.ApplyCoupon(coupon.Code()), ShouldBeTrue)
+				So(coupon.State(), ShouldEqual, "reserved")
+				So(so.RewardLines().Len(), ShouldEqual, 3)
+				So(so.AmountUntaxed(), ShouldAlmostEqual, 310)
+				So(func() { so.ApplyCoupon(coupon.Code()) }, ShouldPanic)
+
+				soCopy := so.Copy(h.SaleOrder().NewData())
+				So(soCopy.OrderLine().Len(), ShouldEqual, 2)
+				So(soCopy.RewardLines().IsEmpty(), ShouldBeTrue)
+				So(soCopy.AmountUntaxed(), ShouldAlmostEqual, 400)
+				lineCopy := so.RewardLines().Records()[0].Copy(h.SaleOrderLine().NewData())
+				So(lineCopy.Promotion().IsEmpty(), ShouldBeTrue)
+				lineCopy.Unlink()
+
+				so.ActionConfirm()
+				So(coupon.State(), ShouldEqual, "used")
+				So(so.RewardLines().Len(), ShouldEqual, 3)
+				So(so.AmountUntaxed(), ShouldAlmostEqual, 310)
+
+				soCopy.ActionConfirm()
+				So(soCopy.State(), ShouldEqual, "sale")
+				So(soCopy.RewardLines().Len(), ShouldEqual, 2)
+				So(soCopy.AmountUntaxed(), ShouldAlmostEqual, 350)
+				So(func() { newOrder().ApplyCoupon(coupon.Code()) }, ShouldPanic)
+				So(func() { newOrder().ApplyCoupon("NOT-A-COUPON") }, ShouldPanic)
+
+				// The discount on the cheapest product applies on at most the whole line
+				halfUnit := h.SaleOrder().Create(env, tsd.quotationData(0.5, 100))
+				halfUnit.ApplyPromotions()
+				So(halfUnit.RewardLines().Len(), ShouldEqual, 1)
+				So(halfUnit.AmountUntaxed(), ShouldAlmostEqual, 25)
+			})
+			Convey("Test margins", func() {
+				tsd.ProductOrder.SetStandardPrice(60)
+				tsd.ServiceOrder.SetStandardPrice(150)
+				so := h.SaleOrder().Create(env, tsd.quotationData(2, 100).
+					CreateOrderLine(tsd.lineData(tsd.ServiceOrder, 1, 200).
+						SetIsOptional(true)))
+				line := so.OrderLine().Filtered(func(r m.SaleOrderLineSet) bool { return !r.IsOptional() })
+				So(line.PurchasePrice(), ShouldEqual, 60)
+				So(line.Margin(), ShouldAlmostEqual, 80)
+				So(line.MarginPercent(), ShouldAlmostEqual, 40)
+				So(so.Margin(), ShouldAlmostEqual, 80)
+				So(so.MarginPercent(), ShouldAlmostEqual, 40)
+				so.OptionalLines().ActionAddOptional()
+				So(so.Margin(), ShouldAlmostEqual, 130)
+				line.SetDiscount(50)
+				So(so.Margin(), ShouldAlmostEqual, 30)
+			})
+			Convey("Test floor prices", func() {
+				tsd.ProductOrder.SetStandardPrice(60)
+				h.ConfigParameter().NewSet(env).SetParam("sale.floor_min_margin", "25")
+				so := h.SaleOrder().Create(env, tsd.quotationData(2, 100))
+				line := so.OrderLine()
+				So(line.FloorPrice(), ShouldAlmostEqual, 80)
+				So(func() { line.SetPriceUnit(70) }, ShouldPanic)
+				line.SetPriceUnit(100)
+				So(func() { line.SetDiscount(30) }, ShouldPanic)
+				line.SetDiscount(20)
+				So(line.BelowFloorPrice(), ShouldBeFalse)
+
+				tsd.ProductOrder.SetMinSalePrice(90)
+				So(line.FloorPrice(), ShouldAlmostEqual, 90)
+				So(line.BelowFloorPrice(), ShouldBeTrue)
+				So(func() { so.ActionConfirm() }, ShouldPanic)
+				So(so.State(), ShouldEqual, "draft")
+
+				h.ConfigParameter().NewSet(env).SetParam("sale.floor_price_policy", "approval")
+				so.Sudo(tsd.User.ID()).ActionConfirm()
+				So(so.State(), ShouldEqual, "to_approve")
+				So(so.Approvals().Level(), ShouldEqual, "manager")
+				So(func() { so.Sudo(tsd.User.ID()).ActionConfirm() }, ShouldPanic)
+				So(so.Approvals().Len(), ShouldEqual, 1)
+				so.Sudo(tsd.Manager.ID()).ActionApprove()
+				line.SetPriceUnit(80)
+				so.Sudo(tsd.User.ID()).ActionConfirm()
+				So(so.State(), ShouldEqual, "to_approve")
+				So(so.Approvals().Filtered(func(r m.SaleOrderApprovalSet) bool { return r.State() == "void" }).Len(), ShouldEqual, 1)
+				so.Sudo(tsd.Manager.ID()).ActionApprove()
+				so.Sudo(tsd.User.ID()).ActionConfirm()
+				So(so.State(), ShouldEqual, "sale")
+			})
+			Convey("Test sale warnings and blocking on customers and products", func() {
+				contact := h.Partner().Create(env, h.Partner().NewData().
+					SetName("Warned Contact").
+					SetParent(tsd.Partner).
+					SetSaleWarn("warning").
+					SetSaleWarnMsg("Check the payment terms"))
+				warning := contact.GetSaleWarning()
+				So(warning.Blocking, ShouldBeFalse)
+				So(warning.Message, ShouldEqual, "Check the payment terms")
+
+				soData := tsd.orderData().
+					SetPartner(contact)
+				so := h.SaleOrder().Create(env, soData)
+				So(so.PartnerWarning(), ShouldContainSubstring, "Check the payment terms")
+
+				tsd.ProductOrder.SetSaleLineWarn("block")
+				tsd.ProductOrder.SetSaleLineWarnMsg("Discontinued")
+				lineData := h.SaleOrderLine().NewData().
+					SetOrder(so).
+					SetName(tsd.ProductOrder.Name()).
+					SetProduct(tsd.ProductOrder).
+					SetProductUomQty(1).
+					SetProductUom(tsd.ProductOrder.Uom())
+				So(func() { h.SaleOrderLine().Create(env, lineData) }, ShouldPanic)
+				line := h.SaleOrderLine().Create(env, lineData.
+					SetName(tsd.ServiceOrder.Name()).
+					SetProduct(tsd.ServiceOrder).
+					SetProductUom(tsd.ServiceOrder.Uom()))
+				So(func() { line.SetProduct(tsd.ProductOrder) }, ShouldPanic)
+				So(line.Product().Equals(tsd.ServiceOrder), ShouldBeTrue)
+
+				tsd.Partner.SetSaleWarn("block")
+				tsd.Partner.SetSaleWarnMsg("Unpaid invoices")
+				warning = contact.GetSaleWarning()
+				So(warning.Blocking, ShouldBeTrue)
+				So(warning.Message, ShouldEqual, "Unpaid invoices")
+				So(func() { h.SaleOrder().Create(env, soData) }, ShouldPanic)
+				So(func() { so.ActionConfirm() }, ShouldPanic)
+				other := h.Partner().Create(env, h.Partner().NewData().SetName("Other Customer"))
+				so.SetPartner(other)
+				So(func() { so.SetPartner(contact) }, ShouldPanic)
+				So(so.Partner().Equals(other), ShouldBeTrue)
+			})
 		}), ShouldBeNil)
 	})
 }
@@ -0,0 +1,198 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hexya-addons/sale/saletypes"
+	"github.com/hexya-erp/hexya/src/actions"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/views"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+func init() {
+
+	h.SaleOrderLine().Methods().PriceBreakdown().DeclareMethod(
+		`PriceBreakdown returns how the unit price and the discount of this line are computed
+		from the pricelist of the order: the product field the price is based on, the pricelist
+		items applied, the unit of measure factor, the currency conversion rate and the resulting discount.`,
+		func(rs m.SaleOrderLineSet) saletypes.PriceBreakdown {
+			rs.EnsureOne()
+			order := rs.Order()
+			pricelist := order.Pricelist()
+			res := saletypes.PriceBreakdown{
+				Product:          rs.Product().NameGet(),
+				Pricelist:        pricelist.Name(),
+				DiscountPolicy:   pricelist.DiscountPolicy(),
+				Quantity:         rs.ProductUomQty(),
+				Uom:              rs.ProductUom().Name(),
+				Currency:         pricelist.Currency().Name(),
+				UomFactor:        1,
+				CurrencyRate:     1,
+				CurrentPriceUnit: rs.PriceUnit(),
+				CurrentDiscount:  rs.Discount(),
+			}
+			if rs.Product().IsEmpty() || rs.ProductUom().IsEmpty() || pricelist.IsEmpty() || order.Partner().IsEmpty() {
+				return res
+			}
+			date := order.DateOrder().ToDate()
+			productContext := rs.Env().Context().
+				WithKey("partner_id", order.Partner().ID()).
+				WithKey("date", date).
+				WithKey("uom", rs.ProductUom().ID())
+			qty := float64(1)
+			if rs.ProductUomQty() != 0 {
+				qty = rs.ProductUomQty()
+			}
+			price, rule := pricelist.WithNewContext(productContext).
+				ComputePriceRule(rs.Product(), qty, order.Partner(), date, rs.ProductUom())
+			res.PricelistPrice = price
+			visited := make(map[int64]bool)
+			for item := rule; item.IsNotEmpty() && !visited[item.ID()]; {
+				visited[item.ID()] = true
+				itemPrice, _ := item.Pricelist().WithNewContext(productContext).
+					ComputePriceRule(rs.Product(), qty, order.Partner(), date, rs.ProductUom())
+				res.Steps = append(res.Steps, saletypes.PriceBreakdownStep{
+					Pricelist: item.Pricelist().Name(),
+					Item:      item.Name(),
+					Rule:      item.Price(),
+					Base:      item.Base(),
+					Price:     itemPrice,
+				})
+				if item.Base() != "pricelist" || item.BasePricelist().IsEmpty() {
+					break
+				}
+				item = item.BasePricelist().GetProductPriceRule(rs.Product(), qty, order.Partner(), date, rs.ProductUom())
+			}
+
+			fieldName, product, currency, productCurrency := realPriceBase(rs.WithNewContext(productContext),
+				rs.Product(), rule, rs.ProductUomQty(), rs.ProductUom())
+			res.BaseField = fieldName
+			res.BasePrice = product.WithContext("uom", rs.Product().Uom().ID()).Get(fieldName).(float64)
+			if !rs.ProductUom().Equals(rs.Product().Uom()) {
+				res.UomFactor = rs.Product().Uom().ComputePrice(1, rs.ProductUom())
+			}
+			res.ProductCurrency = productCurrency.Name()
+			if currency.IsNotEmpty() && !currency.Equals(productCurrency) {
+				res.CurrencyRate = productCurrency.GetConversionRateTo(currency)
+			} else {
+				currency = productCurrency
+			}
+			if !currency.Equals(pricelist.Currency()) {
+				res.CurrencyRate *= currency.WithNewContext(productContext).GetConversionRateTo(pricelist.Currency())
+			}
+			res.ListPrice = res.BasePrice * res.UomFactor * res.CurrencyRate
+			res.Discount = rs.UpdateOnchangeDiscount(h.SaleOrderLine().NewData()).Discount()
+			res.PriceUnit = rs.PricelistPriceUnit()
+			return res
+		})
+
+	h.SaleOrderLine().Methods().PriceBreakdownText().DeclareMethod(
+		`PriceBreakdownText returns the price breakdown of this line as a text that can be
+		shown to the user or recorded in the history of the order.`,
+		func(rs m.SaleOrderLineSet) string {
+			rs.EnsureOne()
+			pb := rs.PriceBreakdown()
+			currency := rs.Order().Pricelist().Currency()
+			baseFields := map[string]string{
+				"LstPrice":      rs.T("Public Price"),
+				"StandardPrice": rs.T("Cost"),
+				"Price":         rs.T("Price of another pricelist"),
+			}
+			texts := []string{
+				rs.T("Product: %s, %s %s", pb.Product, formatQuantity(pb.Quantity), pb.Uom),
+			}
+			if pb.Pricelist == "" {
+				return strings.Join(append(texts, rs.T("No pricelist is set on the order.")), "\n")
+			}
+			policy := rs.T("discount included in the price")
+			if pb.DiscountPolicy == "without_discount" {
+				policy = rs.T("discount shown to the customer")
+			}
+			texts = append(texts, rs.T("Pricelist: %s (%s)", pb.Pricelist, policy))
+			if pb.BaseField != "" {
+				texts = append(texts, rs.T("Based on: %s = %s %s", baseFields[pb.BaseField],
+					formatQuantity(pb.BasePrice), pb.ProductCurrency))
+			}
+			if pb.UomFactor != 1 {
+				texts = append(texts, rs.T("Unit of measure factor: %s", formatQuantity(pb.UomFactor)))
+			}
+			if pb.CurrencyRate != 1 {
+				texts = append(texts, rs.T("Currency rate %s to %s: %s", pb.ProductCurrency, pb.Currency,
+					formatQuantity(pb.CurrencyRate)))
+			}
+			texts = append(texts, rs.T("Price before pricelist: %s", formatAmount(pb.ListPrice, currency)))
+			if len(pb.Steps) == 0 {
+				texts = append(texts, rs.T("No pricelist item applies."))
+			}
+			for i, step := range pb.Steps {
+				texts = append(texts, fmt.Sprintf("%d. %s - %s: %s", i+1, step.Pricelist, step.Rule,
+					formatAmount(step.Price, currency)))
+			}
+			texts = append(texts, rs.T("Pricelist price: %s", formatAmount(pb.PricelistPrice, currency)))
+			if pb.Discount > 0 {
+				texts = append(texts, rs.T("Discount: %s%%", formatQuantity(pb.Discount)))
+			}
+			texts = append(texts, rs.T("Proposed unit price: %s", formatAmount(pb.PriceUnit, currency)))
+			if currency.CompareAmounts(pb.CurrentPriceUnit, pb.PriceUnit) != 0 || pb.CurrentDiscount != pb.Discount {
+				texts = append(texts, rs.T("Actual unit price: %s, discount %s%% (modified on the line)",
+					formatAmount(pb.CurrentPriceUnit, currency), formatQuantity(pb.CurrentDiscount)))
+			}
+			return strings.Join(texts, "\n")
+		})
+
+	h.SaleOrderLine().Methods().LogPriceBreakdown().DeclareMethod(
+		`LogPriceBreakdown records the price breakdown of the lines of this RecordSet
+		in the history of their order.`,
+		func(rs m.SaleOrderLineSet) {
+			for _, line := range rs.Records() {
+				line.Order().LogChange(h.SaleOrderLog().NewData().
+					SetOrderLine(line).
+					SetKind("price_breakdown").
+					SetNewValue(formatAmount(line.PriceUnit(), line.Order().Currency())).
+					SetMessage(line.PriceBreakdownText()))
+			}
+		})
+
+	h.SaleOrderLine().Methods().ActionShowPriceBreakdown().DeclareMethod(
+		`ActionShowPriceBreakdown returns an action showing the price breakdown of this line in a popup.`,
+		func(rs m.SaleOrderLineSet) *actions.Action {
+			rs.EnsureOne()
+			wizard := h.SalePriceBreakdown().Create(rs.Env(), h.SalePriceBreakdown().NewData().
+				SetOrderLine(rs).
+				SetBreakdown(rs.PriceBreakdownText()).
+				SetPriceLadder(rs.PriceLadderText()))
+			return &actions.Action{
+				Type:   actions.ActionActWindow,
+				Name:   rs.T("Price Breakdown"),
+				Model:  "SalePriceBreakdown",
+				ResID:  wizard.ID(),
+				View:   views.MakeViewRef("sale_view_sale_price_breakdown"),
+				Views:  []views.ViewTuple{{ID: "sale_view_sale_price_breakdown", Type: views.ViewTypeForm}},
+				Target: "new",
+			}
+		})
+
+	h.SalePriceBreakdown().DeclareTransientModel()
+
+	h.SalePriceBreakdown().AddFields(map[string]models.FieldDefinition{
+		"OrderLine": models.Many2OneField{String: "Order Line", RelationModel: h.SaleOrderLine(), ReadOnly: true},
+		"Breakdown": models.TextField{String: "Price Breakdown", ReadOnly: true},
+		"PriceLadder": models.TextField{String: "Volume Prices", ReadOnly: true,
+			Help: "Unit price of the product after discount from each quantity that gets another price from the pricelist."},
+	})
+
+	h.SalePriceBreakdown().Methods().ActionLogBreakdown().DeclareMethod(
+		`ActionLogBreakdown records the price breakdown of the line of this wizard in the history of its order.`,
+		func(rs m.SalePriceBreakdownSet) *actions.Action {
+			rs.EnsureOne()
+			rs.OrderLine().LogPriceBreakdown()
+			return &actions.Action{Type: actions.ActionCloseWindow}
+		})
+
+}
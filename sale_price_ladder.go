@@ -0,0 +1,170 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/hexya-addons/decimalPrecision"
+	"github.com/hexya-addons/sale/saletypes"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/hexya/src/tools/nbutils"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+// pricelistQuantityBreaks returns the minimum quantities, in the unit of measure of the product,
+// of the items of the given pricelist that may apply to the given product at the given date,
+// and of the items of the pricelists these items are based on.
+func pricelistQuantityBreaks(pricelist m.ProductPricelistSet, product m.ProductProductSet, date dates.Date) []float64 {
+	categs := h.ProductCategory().NewSet(pricelist.Env())
+	for categ := product.Category(); categ.IsNotEmpty(); categ = categ.Parent() {
+		categs = categs.Union(categ)
+	}
+	var res []float64
+	visited := make(map[int64]bool)
+	var walk func(pl m.ProductPricelistSet)
+	walk = func(pl m.ProductPricelistSet) {
+		if pl.IsEmpty() || visited[pl.ID()] {
+			return
+		}
+		visited[pl.ID()] = true
+		items := h.ProductPricelistItem().Search(pl.Env(), q.ProductPricelistItem().Pricelist().Equals(pl).
+			AndCond(q.ProductPricelistItem().ProductTmpl().IsNull().Or().ProductTmpl().Equals(product.ProductTmpl())).
+			AndCond(q.ProductPricelistItem().Product().IsNull().Or().Product().Equals(product)).
+			AndCond(q.ProductPricelistItem().Category().IsNull().Or().Category().In(categs)).
+			AndCond(q.ProductPricelistItem().DateStart().IsNull().Or().DateStart().LowerOrEqual(date)).
+			AndCond(q.ProductPricelistItem().DateEnd().IsNull().Or().DateEnd().GreaterOrEqual(date)))
+		for _, item := range items.Records() {
+			if item.MinQuantity() > 0 {
+				res = append(res, item.MinQuantity())
+			}
+			if item.Base() == "pricelist" {
+				walk(item.BasePricelist())
+			}
+		}
+	}
+	walk(pricelist)
+	return res
+}
+
+func init() {
+
+	h.SaleOrderLine().Methods().PriceAtQuantity().DeclareMethod(
+		`PriceAtQuantity returns the unit price and the discount this line would get from the
+		pricelist of its order if its quantity was the given quantity, in its unit of measure.`,
+		func(rs m.SaleOrderLineSet, qty float64) (float64, float64) {
+			rs.EnsureOne()
+			order := rs.Order()
+			pricelist := order.Pricelist()
+			date := order.DateOrder().ToDate()
+			productContext := rs.Env().Context().
+				WithKey("partner_id", order.Partner().ID()).
+				WithKey("date", date).
+				WithKey("uom", rs.ProductUom().ID())
+			product := rs.Product().
+				WithContext("lang", order.Partner().Lang()).
+				WithContext("partner", order.Partner().ID()).
+				WithContext("quantity", qty).
+				WithContext("date", date).
+				WithContext("pricelist", pricelist.ID()).
+				WithContext("uom", rs.ProductUom().ID())
+			price, rule := pricelist.WithNewContext(productContext).
+				ComputePriceRule(rs.Product(), qty, order.Partner(), date, rs.ProductUom())
+			priceUnit, discount := price, float64(0)
+			if pricelist.DiscountPolicy() == "without_discount" {
+				listPrice, currency := rs.WithNewContext(productContext).
+					GetRealPriceCurrency(product, rule, qty, rs.ProductUom(), pricelist)
+				if !currency.Equals(pricelist.Currency()) {
+					listPrice = currency.WithNewContext(productContext).Compute(listPrice, pricelist.Currency(), true)
+				}
+				// Same as GetDisplayPrice and UpdateOnchangeDiscount
+				priceUnit = math.Max(listPrice, price)
+				if listPrice > price && h.User().NewSet(rs.Env()).CurrentUser().HasGroup(GroupDiscountPerSOLine.ID) {
+					discount = (listPrice - price) / listPrice * 100
+				}
+			}
+			priceUnit = h.AccountTax().NewSet(rs.Env()).FixTaxIncludedPrice(priceUnit, product.Taxes(), rs.Tax())
+			return priceUnit, discount
+		})
+
+	h.SaleOrderLine().Methods().PriceLadder().DeclareMethod(
+		`PriceLadder returns the prices of the product of this line under the pricelist, the partner
+		and the date of its order, for each quantity from which the pricelist gives another price.
+		Quantities are expressed in the unit of measure of the line.
+
+		The first step starts at a quantity of 1. The step that applies to the current quantity
+		of the line is flagged as current. The ladder is empty if no price can be computed.`,
+		func(rs m.SaleOrderLineSet) []saletypes.PriceLadderStep {
+			rs.EnsureOne()
+			order := rs.Order()
+			if rs.Product().IsEmpty() || rs.ProductUom().IsEmpty() ||
+				order.Pricelist().IsEmpty() || order.Partner().IsEmpty() {
+				return nil
+			}
+			quantities := []float64{1}
+			for _, qty := range pricelistQuantityBreaks(order.Pricelist(), rs.Product(), order.DateOrder().ToDate()) {
+				if !rs.ProductUom().Equals(rs.Product().Uom()) {
+					// Round up so that the quantity reaches the break in the unit of measure of the product
+					qty = nbutils.Ceil(rs.Product().Uom().ComputeQuantity(qty, rs.ProductUom(), false), rs.ProductUom().Rounding())
+				}
+				if qty > 1 {
+					quantities = append(quantities, qty)
+				}
+			}
+			sort.Float64s(quantities)
+			currency := order.Pricelist().Currency()
+			var res []saletypes.PriceLadderStep
+			for i, qty := range quantities {
+				if i > 0 && qty == quantities[i-1] {
+					continue
+				}
+				priceUnit, discount := rs.PriceAtQuantity(qty)
+				price := priceUnit * (1 - discount/100)
+				if len(res) > 0 && currency.CompareAmounts(res[len(res)-1].Price, price) == 0 {
+					continue
+				}
+				res = append(res, saletypes.PriceLadderStep{
+					MinQuantity: qty,
+					PriceUnit:   priceUnit,
+					Discount:    discount,
+					Price:       price,
+				})
+			}
+			current := math.Max(rs.ProductUomQty(), 1)
+			for i := len(res) - 1; i >= 0; i-- {
+				if res[i].MinQuantity <= current {
+					res[i].Current = true
+					break
+				}
+			}
+			return res
+		})
+
+	h.SaleOrderLine().Methods().PriceLadderText().DeclareMethod(
+		`PriceLadderText returns the price ladder of this line as a text that can be shown to the user.`,
+		func(rs m.SaleOrderLineSet) string {
+			rs.EnsureOne()
+			currency := rs.Order().Pricelist().Currency()
+			discountPrecision := decimalPrecision.GetPrecision("Discount").ToPrecision()
+			var texts []string
+			for _, step := range rs.PriceLadder() {
+				text := rs.T("From %s %s: %s", formatQuantity(step.MinQuantity), rs.ProductUom().Name(),
+					formatAmount(step.Price, currency))
+				if step.Discount > 0 {
+					text = rs.T("%s (%s - %s%%)", text, formatAmount(step.PriceUnit, currency),
+						formatQuantity(nbutils.Round(step.Discount, discountPrecision)))
+				}
+				if step.Current {
+					text = rs.T("%s (current quantity)", text)
+				}
+				texts = append(texts, text)
+			}
+			return strings.Join(texts, "\n")
+		})
+
+}
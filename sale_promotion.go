@@ -0,0 +1,408 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
+)
+
+// newCouponCode returns a new random coupon code.
+func newCouponCode() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+func init() {
+
+	h.SalePromotion().DeclareModel()
+	h.SalePromotion().SetDefaultOrder("Sequence", "ID")
+
+	h.SalePromotion().AddFields(map[string]models.FieldDefinition{
+		"Name":     models.CharField{String: "Promotion", Required: true, Translate: true},
+		"Sequence": models.IntegerField{Default: models.DefaultValue(10)},
+		"Active":   models.BooleanField{Default: models.DefaultValue(true)},
+		"Company": models.Many2OneField{RelationModel: h.Company(),
+			Default: func(env models.Environment) interface{} {
+				return h.Company().NewSet(env).CompanyDefaultGet()
+			}},
+		"DateFrom": models.DateField{String: "Start Date",
+			Help: "If set, this promotion only applies to orders made from this date."},
+		"DateTo": models.DateField{String: "End Date",
+			Help: "If set, this promotion only applies to orders made until this date."},
+		"MinAmount": models.FloatField{String: "Minimum Amount",
+			Help: "Minimum untaxed amount of the order for this promotion to apply."},
+		"Products": models.Many2ManyField{String: "Products", RelationModel: h.ProductProduct(),
+			JSON: "product_ids", Help: "If set, the order must contain one of these products."},
+		"Categories": models.Many2ManyField{String: "Product Categories", RelationModel: h.ProductCategory(),
+			JSON: "category_ids", Help: "If set, the order must contain a product of one of these categories."},
+		"PartnerTags": models.Many2ManyField{String: "Customer Tags", RelationModel: h.PartnerCategory(),
+			JSON: "partner_tag_ids", Help: "If set, the customer must have one of these tags."},
+		"NeedCoupon": models.BooleanField{String: "Coupon Required",
+			Help: "If set, this promotion only applies to orders on which one of its coupons has been applied."},
+		"RewardType": models.SelectionField{String: "Reward", Selection: types.Selection{
+			"product":          "Free product",
+			"discount_percent": "Percentage discount",
+			"discount_fixed":   "Fixed amount discount",
+		}, Required: true, Default: models.DefaultValue("discount_percent")},
+		"RewardProduct": models.Many2OneField{String: "Free Product", RelationModel: h.ProductProduct(),
+			Filter: q.ProductProduct().SaleOk().Equals(true)},
+		"RewardQuantity":  models.FloatField{String: "Free Quantity", Default: models.DefaultValue(1.0)},
+		"DiscountPercent": models.FloatField{String: "Discount (%)"},
+		"DiscountApplyOn": models.SelectionField{String: "Discount Applies On", Selection: types.Selection{
+			"order":    "Whole order",
+			"cheapest": "Cheapest product",
+			"products": "Specific products",
+		}, Default: models.DefaultValue("order"),
+			Help: "Cheapest product: the discount applies on one unit of the cheapest product of the order."},
+		"DiscountProducts": models.Many2ManyField{String: "Discounted Products", RelationModel: h.ProductProduct(),
+			JSON: "discount_product_ids", M2MLinkModelName: "SalePromotionDiscountProductRel",
+			M2MOurField: "Promotion", M2MTheirField: "Product"},
+		"DiscountFixed": models.FloatField{String: "Discount Amount",
+			Help: "Amount deducted from the untaxed amount of the order."},
+		"Coupons": models.One2ManyField{String: "Coupons", RelationModel: h.SaleCoupon(),
+			ReverseFK: "Promotion", JSON: "coupon_ids"},
+	})
+
+	h.SalePromotion().Methods().BaseLines().DeclareMethod(
+		`BaseLines returns the lines of the given order that are taken into account by promotions,
+		i.e. all lines except optional lines, global discount lines and reward lines.`,
+		func(rs m.SalePromotionSet, order m.SaleOrderSet) m.SaleOrderLineSet {
+			return order.OrderLine().Filtered(func(r m.SaleOrderLineSet) bool {
+				return !r.IsOptional() && !r.IsDiscountLine() && r.Promotion().IsEmpty()
+			})
+		})
+
+	h.SalePromotion().Methods().Matches().DeclareMethod(
+		`Matches returns true if this promotion applies to the given order, that is if the order
+		meets its conditions and, when a coupon is required, if one of its coupons has been applied on the order.`,
+		func(rs m.SalePromotionSet, order m.SaleOrderSet) bool {
+			rs.EnsureOne()
+			if rs.NeedCoupon() && order.Coupons().Filtered(func(r m.SaleCouponSet) bool {
+				return r.Promotion().Equals(rs)
+			}).IsEmpty() {
+				return false
+			}
+			return rs.ConditionsMet(order)
+		})
+
+	h.SalePromotion().Methods().ConditionsMet().DeclareMethod(
+		`ConditionsMet returns true if the given order meets the conditions of this promotion,
+		regardless of the coupons applied on the order.`,
+		func(rs m.SalePromotionSet, order m.SaleOrderSet) bool {
+			rs.EnsureOne()
+			if rs.Company().IsNotEmpty() && !rs.Company().Equals(order.Company()) {
+				return false
+			}
+			date := order.DateOrder().ToDate()
+			if !rs.DateFrom().IsZero() && date.Lower(rs.DateFrom()) {
+				return false
+			}
+			if !rs.DateTo().IsZero() && date.Greater(rs.DateTo()) {
+				return false
+			}
+			lines := rs.BaseLines(order)
+			if rs.MinAmount() > 0 {
+				var amount float64
+				for _, line := range lines.Records() {
+					amount += line.PriceSubtotal()
+				}
+				if amount < rs.MinAmount() {
+					return false
+				}
+			}
+			if rs.Products().IsNotEmpty() && lines.Filtered(func(r m.SaleOrderLineSet) bool {
+				return r.Product().Intersect(rs.Products()).IsNotEmpty()
+			}).IsEmpty() {
+				return false
+			}
+			if rs.Categories().IsNotEmpty() && lines.Filtered(func(r m.SaleOrderLineSet) bool {
+				for categ := r.Product().Category(); categ.IsNotEmpty(); categ = categ.Parent() {
+					if categ.Intersect(rs.Categories()).IsNotEmpty() {
+						return true
+					}
+				}
+				return false
+			}).IsEmpty() {
+				return false
+			}
+			if rs.PartnerTags().IsNotEmpty() {
+				tags := order.Partner().Categories().Union(order.Partner().CommercialPartner().Categories())
+				if tags.Intersect(rs.PartnerTags()).IsEmpty() {
+					return false
+				}
+			}
+			return true
+		})
+
+	h.SalePromotion().Methods().RewardLinesData().DeclareMethod(
+		`RewardLinesData returns the data of the reward lines of this promotion for the given order.`,
+		func(rs m.SalePromotionSet, order m.SaleOrderSet) []m.SaleOrderLineData {
+			rs.EnsureOne()
+			lines := rs.BaseLines(order)
+			var res []m.SaleOrderLineData
+			switch rs.RewardType() {
+			case "product":
+				if rs.RewardProduct().IsEmpty() {
+					return nil
+				}
+				res = append(res, h.SaleOrderLine().NewData().
+					SetOrder(order).
+					SetSequence(9999).
+					SetProduct(rs.RewardProduct()).
+					SetName(rs.RewardProduct().NameGet()).
+					SetProductUomQty(rs.RewardQuantity()).
+					SetProductUom(rs.RewardProduct().Uom()).
+					SetDiscount(100))
+			case "discount_percent":
+				percent := math.Min(rs.DiscountPercent(), 100)
+				name := rs.T("%s: %s%% discount", rs.Name(), strconv.FormatFloat(percent, 'f', -1, 64))
+				switch rs.DiscountApplyOn() {
+				case "cheapest":
+					var cheapest m.SaleOrderLineSet
+					for _, line := range lines.Records() {
+						if line.ProductUomQty() <= 0 || line.PriceReduce() <= 0 {
+							continue
+						}
+						if cheapest == nil || line.PriceReduce() < cheapest.PriceReduce() {
+							cheapest = line
+						}
+					}
+					if cheapest == nil {
+						return nil
+					}
+					// The discount applies on one unit of the cheapest line, or on the whole line if less
+					qty := cheapest.ProductUomQty()
+					name = rs.T("%s on %s", name, cheapest.Product().NameGet())
+					res = discountLinesData(order, cheapest, percent*math.Min(1, qty)/qty, name)
+				case "products":
+					lines = lines.Filtered(func(r m.SaleOrderLineSet) bool {
+						return r.Product().Intersect(rs.DiscountProducts()).IsNotEmpty()
+					})
+					res = discountLinesData(order, lines, percent, name)
+				default:
+					res = discountLinesData(order, lines, percent, name)
+				}
+			case "discount_fixed":
+				var base float64
+				for _, line := range lines.Records() {
+					base += line.PriceSubtotal()
+				}
+				if base <= 0 {
+					return nil
+				}
+				percent := math.Min(rs.DiscountFixed()/base*100, 100)
+				res = discountLinesData(order, lines, percent, rs.Name())
+			}
+			for _, data := range res {
+				data.SetPromotion(rs)
+			}
+			return res
+		})
+
+	h.SalePromotion().Methods().GenerateCoupons().DeclareMethod(
+		`GenerateCoupons creates the given number of new coupons for this promotion.`,
+		func(rs m.SalePromotionSet, number int) m.SaleCouponSet {
+			rs.EnsureOne()
+			coupons := h.SaleCoupon().NewSet(rs.Env())
+			for i := 0; i < number; i++ {
+				coupons = coupons.Union(h.SaleCoupon().Create(rs.Env(), h.SaleCoupon().NewData().
+					SetPromotion(rs)))
+			}
+			return coupons
+		})
+
+	h.SaleCoupon().DeclareModel()
+	h.SaleCoupon().SetDefaultOrder("ID desc")
+
+	h.SaleCoupon().AddFields(map[string]models.FieldDefinition{
+		"Code": models.CharField{String: "Code", Required: true, Unique: true, Index: true, NoCopy: true,
+			Default: func(env models.Environment) interface{} {
+				return newCouponCode()
+			}},
+		"Promotion": models.Many2OneField{String: "Promotion", RelationModel: h.SalePromotion(), Required: true,
+			OnDelete: models.Cascade, Index: true},
+		"State": models.SelectionField{String: "Status", Selection: types.Selection{
+			"new":      "Valid",
+			"reserved": "Applied on a quotation",
+			"used":     "Used",
+		}, Required: true, ReadOnly: true, NoCopy: true, Default: models.DefaultValue("new")},
+		"Order": models.Many2OneField{String: "Sales Order", RelationModel: h.SaleOrder(), ReadOnly: true,
+			NoCopy: true, Index: true, OnDelete: models.SetNull,
+			Help: "Order on which this coupon has been applied."},
+		"DateUsed": models.DateTimeField{String: "Date Used", ReadOnly: true, NoCopy: true},
+	})
+
+	h.SaleOrder().AddFields(map[string]models.FieldDefinition{
+		"Coupons": models.One2ManyField{String: "Coupons", RelationModel: h.SaleCoupon(),
+			ReverseFK: "Order", JSON: "coupon_ids", ReadOnly: true},
+	})
+
+	h.SaleOrderLine().AddFields(map[string]models.FieldDefinition{
+		"Promotion": models.Many2OneField{String: "Promotion", RelationModel: h.SalePromotion(),
+			ReadOnly: true, Index: true, OnDelete: models.SetNull, NoCopy: true,
+			Help: "Set on the reward lines of promotions."},
+	})
+
+	h.SaleOrder().Methods().CopyData().Extend("",
+		func(rs m.SaleOrderSet, overrides m.SaleOrderData) m.SaleOrderData {
+			rs.EnsureOne()
+			rewards := rs.RewardLines()
+			if rewards.IsEmpty() || overrides.HasOrderLine() || rs.Env().Context().GetBool("sale_revision_snapshot") {
+				return rs.Super().CopyData(overrides)
+			}
+			// Reward lines are not copied: the promotions are applied again on the new quotation
+			data := rs.Super().CopyData(overrides).UnsetOrderLine()
+			for _, line := range rs.OrderLine().Subtract(rewards).Records() {
+				data.CreateOrderLine(line.CopyData(h.SaleOrderLine().NewData()).UnsetOrder())
+			}
+			return data
+		})
+
+	h.SaleOrderLine().Methods().ComputeTax().Extend("",
+		func(rs m.SaleOrderLineSet) m.SaleOrderLineData {
+			if rs.Promotion().IsNotEmpty() && rs.Promotion().RewardType() != "product" {
+				// Discount rewards keep the taxes of the lines they discount
+				return h.SaleOrderLine().NewData().SetTax(rs.Tax())
+			}
+			return rs.Super().ComputeTax()
+		})
+
+	h.SaleOrder().Methods().RewardLines().DeclareMethod(
+		`RewardLines returns the reward lines of the promotions of this order.`,
+		func(rs m.SaleOrderSet) m.SaleOrderLineSet {
+			rs.EnsureOne()
+			return rs.OrderLine().Filtered(func(r m.SaleOrderLineSet) bool { return r.Promotion().IsNotEmpty() })
+		})
+
+	h.SaleOrder().Methods().ApplyPromotions().DeclareMethod(
+		`ApplyPromotions updates the reward lines of the quotations of this RecordSet:
+		the reward lines of the promotions that do not apply anymore are removed and
+		the reward lines of the applicable promotions are added.
+
+		The reward lines are computed again each time, so that this method can be
+		called as many times as needed.`,
+		func(rs m.SaleOrderSet) bool {
+			for _, order := range rs.Records() {
+				if order.State() != "draft" && order.State() != "sent" {
+					panic(rs.T("Promotions can only be applied to quotations, but %s is not a quotation.", order.Name()))
+				}
+			}
+			promotions := h.SalePromotion().Search(rs.Env(), q.SalePromotion().Active().Equals(true))
+			for _, order := range rs.Records() {
+				if rewards := order.RewardLines(); rewards.IsNotEmpty() {
+					rewards.Unlink()
+				}
+				for _, promotion := range promotions.Records() {
+					if !promotion.Matches(order) {
+						continue
+					}
+					for _, data := range promotion.RewardLinesData(order) {
+						line := h.SaleOrderLine().Create(rs.Env(), data)
+						if promotion.RewardType() == "product" {
+							line.ApplyProductChange()
+							line.Write(h.SaleOrderLine().NewData().SetDiscount(100))
+						}
+					}
+				}
+			}
+			return true
+		})
+
+	h.SaleOrder().Methods().ApplyCoupon().DeclareMethod(
+		`ApplyCoupon applies the coupon with the given code on this quotation and updates its promotions.
+		It panics if the coupon does not exist or has already been used.`,
+		func(rs m.SaleOrderSet, code string) bool {
+			rs.EnsureOne()
+			coupon := h.SaleCoupon().NewSet(rs.Env()).Sudo().Search(q.SaleCoupon().Code().Equals(strings.TrimSpace(code)))
+			switch {
+			case coupon.IsEmpty() || !coupon.Promotion().Active():
+				panic(rs.T("The coupon code %s is not valid.", code))
+			case coupon.Order().Equals(rs):
+				panic(rs.T("The coupon %s has already been applied on this order.", coupon.Code()))
+			case coupon.State() != "new":
+				panic(rs.T("The coupon %s has already been used.", coupon.Code()))
+			}
+			if !coupon.Promotion().ConditionsMet(rs) {
+				panic(rs.T("The coupon %s cannot be used on this order.", coupon.Code()))
+			}
+			coupon.Write(h.SaleCoupon().NewData().
+				SetOrder(rs).
+				SetState("reserved"))
+			return rs.ApplyPromotions()
+		})
+
+	h.SaleOrder().Methods().ReleaseCoupons().DeclareMethod(
+		`ReleaseCoupons detaches the coupons of the orders of this RecordSet that have not been used,
+		so that they can be applied on another order.`,
+		func(rs m.SaleOrderSet) {
+			for _, order := range rs.Records() {
+				coupons := order.Coupons().Sudo().Filtered(func(r m.SaleCouponSet) bool { return r.State() == "reserved" })
+				if coupons.IsEmpty() {
+					continue
+				}
+				coupons.Write(h.SaleCoupon().NewData().
+					SetOrder(h.SaleOrder().NewSet(rs.Env())).
+					SetState("new"))
+			}
+		})
+
+	h.SaleOrder().Methods().ActionConfirm().Extend("",
+		func(rs m.SaleOrderSet) bool {
+			quotations := rs.Filtered(func(r m.SaleOrderSet) bool { return r.State() == "draft" || r.State() == "sent" })
+			if quotations.IsNotEmpty() {
+				// Reward lines are brought up to date with the confirmed lines
+				quotations.ApplyPromotions()
+			}
+			res := rs.Super().ActionConfirm()
+			for _, order := range rs.Records() {
+				if order.State() != "sale" && order.State() != "done" {
+					continue
+				}
+				coupons := order.Coupons().Sudo().Filtered(func(r m.SaleCouponSet) bool { return r.State() == "reserved" })
+				if coupons.IsEmpty() {
+					continue
+				}
+				coupons.Write(h.SaleCoupon().NewData().
+					SetState("used").
+					SetDateUsed(dates.Now()))
+			}
+			return res
+		})
+
+	h.SaleOrder().Methods().ActionCancel().Extend("",
+		func(rs m.SaleOrderSet) bool {
+			res := rs.Super().ActionCancel()
+			rs.ReleaseCoupons()
+			return res
+		})
+
+	h.SaleCouponWizard().DeclareTransientModel()
+
+	h.SaleCouponWizard().AddFields(map[string]models.FieldDefinition{
+		"Code": models.CharField{String: "Coupon Code", Required: true},
+	})
+
+	h.SaleCouponWizard().Methods().ActionApplyCoupon().DeclareMethod(
+		`ActionApplyCoupon applies the coupon of this wizard on the order selected in the context.`,
+		func(rs m.SaleCouponWizardSet) bool {
+			rs.EnsureOne()
+			order := h.SaleOrder().Browse(rs.Env(), rs.Env().Context().GetIntegerSlice("active_ids"))
+			return order.ApplyCoupon(rs.Code())
+		})
+
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"strings"
+
+	"github.com/hexya-erp/hexya/src/tools/strutils"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+func init() {
+
+	h.SaleOrder().Methods().StateDescription().DeclareMethod(
+		`StateDescription returns a short description of the state of this order, to be used in messages.`,
+		func(rs m.SaleOrderSet) string {
+			rs.EnsureOne()
+			switch rs.State() {
+			case "sale":
+				return rs.T("confirmed")
+			case "done":
+				return rs.T("locked")
+			case "cancel":
+				return rs.T("cancelled")
+			case "revised":
+				return rs.T("an old revision")
+			}
+			return rs.T("a quotation")
+		})
+
+	h.SaleOrder().Methods().CheckReadOnlyFields().DeclareMethod(
+		`CheckReadOnlyFields panics if the given data modifies fields of confirmed, locked or
+		cancelled orders of this RecordSet that can only be set on quotations.
+
+		The analytic account can still be set on orders that do not have one yet.
+		The order lines of locked and cancelled orders cannot be modified.`,
+		func(rs m.SaleOrderSet, data m.SaleOrderData) {
+			if forcedWrite(rs.Env()) {
+				return
+			}
+			for _, order := range rs.Records() {
+				if !strutils.IsIn(order.State(), "sale", "done", "cancel") {
+					continue
+				}
+				var fields []string
+				if data.HasDateOrder() && !data.DateOrder().Equal(order.DateOrder()) {
+					fields = append(fields, rs.T("Order Date"))
+				}
+				if data.HasValidityDate() && !data.ValidityDate().Equal(order.ValidityDate()) {
+					fields = append(fields, rs.T("Expiration Date"))
+				}
+				if data.HasPartner() && !data.Partner().Equals(order.Partner()) {
+					fields = append(fields, rs.T("Customer"))
+				}
+				if data.HasPartnerInvoice() && !data.PartnerInvoice().Equals(order.PartnerInvoice()) {
+					fields = append(fields, rs.T("Invoice Address"))
+				}
+				if data.HasPartnerShipping() && !data.PartnerShipping().Equals(order.PartnerShipping()) {
+					fields = append(fields, rs.T("Delivery Address"))
+				}
+				if data.HasPricelist() && !data.Pricelist().Equals(order.Pricelist()) {
+					fields = append(fields, rs.T("Pricelist"))
+				}
+				if data.HasProject() && order.Project().IsNotEmpty() && !data.Project().Equals(order.Project()) {
+					fields = append(fields, rs.T("Analytic Account"))
+				}
+				if data.HasOrderLine() && order.State() != "sale" {
+					fields = append(fields, rs.T("Order Lines"))
+				}
+				if len(fields) > 0 {
+					panic(rs.T("%s is %s, the following fields cannot be modified anymore: %s",
+						order.Name(), order.StateDescription(), strings.Join(fields, ", ")))
+				}
+			}
+		})
+
+	h.SaleOrder().Methods().Write().Extend("",
+		func(rs m.SaleOrderSet, data m.SaleOrderData) bool {
+			rs.CheckReadOnlyFields(data)
+			return rs.Super().Write(data)
+		})
+
+	h.SaleOrderLine().Methods().CheckReadOnlyFields().DeclareMethod(
+		`CheckReadOnlyFields panics if the given data modifies the lines of this RecordSet
+		that belong to locked or cancelled orders.`,
+		func(rs m.SaleOrderLineSet, data m.SaleOrderLineData) {
+			if forcedWrite(rs.Env()) {
+				return
+			}
+			for _, line := range rs.Records() {
+				order := line.Order()
+				if order.State() != "done" && order.State() != "cancel" {
+					continue
+				}
+				var fields []string
+				if data.HasOrder() && !data.Order().Equals(order) {
+					fields = append(fields, rs.T("Order Reference"))
+				}
+				if data.HasProduct() && !data.Product().Equals(line.Product()) {
+					fields = append(fields, rs.T("Product"))
+				}
+				if data.HasName() && data.Name() != line.Name() {
+					fields = append(fields, rs.T("Description"))
+				}
+				if data.HasProductUomQty() && data.ProductUomQty() != line.ProductUomQty() {
+					fields = append(fields, rs.T("Quantity"))
+				}
+				if data.HasProductUom() && !data.ProductUom().Equals(line.ProductUom()) {
+					fields = append(fields, rs.T("Unit of Measure"))
+				}
+				if data.HasPriceUnit() && data.PriceUnit() != line.PriceUnit() {
+					fields = append(fields, rs.T("Unit Price"))
+				}
+				if data.HasDiscount() && data.Discount() != line.Discount() {
+					fields = append(fields, rs.T("Discount"))
+				}
+				if data.HasTax() && !data.Tax().Equals(line.Tax()) {
+					fields = append(fields, rs.T("Taxes"))
+				}
+				if data.HasIsOptional() && data.IsOptional() != line.IsOptional() {
+					fields = append(fields, rs.T("Optional"))
+				}
+				if len(fields) > 0 {
+					panic(rs.T("%s is %s, the following fields of its lines cannot be modified anymore: %s",
+						order.Name(), order.StateDescription(), strings.Join(fields, ", ")))
+				}
+			}
+		})
+
+	h.SaleOrderLine().Methods().Create().Extend("",
+		func(rs m.SaleOrderLineSet, data m.SaleOrderLineData) m.SaleOrderLineSet {
+			if order := data.Order(); !forcedWrite(rs.Env()) && order.IsNotEmpty() &&
+				(order.State() == "done" || order.State() == "cancel") {
+				panic(rs.T("%s is %s, lines cannot be added to it anymore.", order.Name(), order.StateDescription()))
+			}
+			return rs.Super().Create(data)
+		})
+
+	h.SaleOrderLine().Methods().Write().Extend("",
+		func(rs m.SaleOrderLineSet, data m.SaleOrderLineData) bool {
+			rs.CheckReadOnlyFields(data)
+			return rs.Super().Write(data)
+		})
+
+}
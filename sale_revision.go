@@ -0,0 +1,221 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hexya-addons/sale/saletypes"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+// forcedWrite returns true if sale orders are written in the given environment
+// while a revision is being created or when hexya updates stored computed fields.
+//
+// The read only rules of old revisions and confirmed orders do not apply in this case.
+func forcedWrite(env models.Environment) bool {
+	return env.Context().GetBool("sale_revision_snapshot") || env.Context().GetBool("hexya_force_compute_write")
+}
+
+func init() {
+
+	h.SaleOrder().AddFields(map[string]models.FieldDefinition{
+		"UnrevisedName": models.CharField{String: "Original Reference", ReadOnly: true, NoCopy: true,
+			Help: "Reference of the quotation before its first revision."},
+		"RevisionNumber": models.IntegerField{String: "Revision", ReadOnly: true, NoCopy: true, GoType: new(int)},
+		"CurrentRevision": models.Many2OneField{String: "Current Revision", RelationModel: h.SaleOrder(),
+			ReadOnly: true, NoCopy: true, Index: true, OnDelete: models.Cascade,
+			Help: "Set on the old revisions of a quotation. This is the quotation that replaces them."},
+		"OldRevisions": models.One2ManyField{String: "Old Revisions", RelationModel: h.SaleOrder(),
+			ReverseFK: "CurrentRevision", JSON: "old_revision_ids", ReadOnly: true},
+		"RevisionDiff": models.TextField{String: "Changes in Current Revision",
+			Compute: h.SaleOrder().Methods().ComputeRevisionDiff()},
+	})
+
+	h.SaleOrder().Methods().IsOldRevision().DeclareMethod(
+		`IsOldRevision returns true if this order has been replaced by a newer revision.`,
+		func(rs m.SaleOrderSet) bool {
+			rs.EnsureOne()
+			return rs.CurrentRevision().IsNotEmpty()
+		})
+
+	h.SaleOrder().Methods().CheckRevisionWritable().DeclareMethod(
+		`CheckRevisionWritable panics if one of the orders of this RecordSet is an old revision.
+		Old revisions are kept as they were when they have been replaced.`,
+		func(rs m.SaleOrderSet) {
+			if forcedWrite(rs.Env()) {
+				return
+			}
+			for _, order := range rs.Records() {
+				if order.IsOldRevision() {
+					panic(rs.T("%s is an old revision of %s and cannot be modified.",
+						order.Name(), order.CurrentRevision().Name()))
+				}
+			}
+		})
+
+	h.SaleOrder().Methods().ActionNewRevision().DeclareMethod(
+		`ActionNewRevision creates a new revision of the quotations of this RecordSet.
+
+		The current state of each quotation is saved in a read-only copy linked to it, in the
+		'revised' state, and the quotation itself gets a new reference with the revision number (e.g. SO042-R2).
+		The quotation keeps its identity so that all documents linked to it remain linked.`,
+		func(rs m.SaleOrderSet) bool {
+			for _, order := range rs.Records() {
+				order.CheckRevisionWritable()
+				if order.State() != "draft" && order.State() != "sent" && order.State() != "expired" {
+					panic(rs.T("Only quotations can be revised."))
+				}
+				baseName := order.UnrevisedName()
+				if baseName == "" {
+					baseName = order.Name()
+				}
+				number := order.RevisionNumber()
+				if number < 1 {
+					number = 1
+				}
+				order.WithContext("sale_revision_snapshot", true).Copy(h.SaleOrder().NewData().
+					SetName(order.Name()).
+					SetUnrevisedName(baseName).
+					SetRevisionNumber(number).
+					SetCurrentRevision(order).
+					SetState("revised").
+					SetClientOrderRef(order.ClientOrderRef()).
+					SetDateOrder(order.DateOrder()).
+					SetValidityDate(order.ValidityDate()))
+				oldName := order.Name()
+				newName := fmt.Sprintf("%s-R%d", baseName, number+1)
+				order.WithContext("state_change_reason", rs.T("New revision %s", newName)).
+					Write(h.SaleOrder().NewData().
+						SetName(newName).
+						SetUnrevisedName(baseName).
+						SetRevisionNumber(number + 1).
+						SetState("draft"))
+				order.LogChange(h.SaleOrderLog().NewData().
+					SetKind("revision").
+					SetOldValue(oldName).
+					SetNewValue(newName).
+					SetMessage(rs.T("New revision %s replaces %s", newName, oldName)))
+			}
+			return true
+		})
+
+	h.SaleOrder().Methods().DiffRevision().DeclareMethod(
+		`DiffRevision compares the lines of this order with the lines of the given order,
+		which is usually another revision of the same quotation.
+
+		Lines are matched by product, in the order of the lines. The returned differences
+		describe the changes from this order to the other one.`,
+		func(rs m.SaleOrderSet, other m.SaleOrderSet) []saletypes.RevisionLineDiff {
+			rs.EnsureOne()
+			other.EnsureOne()
+			pending := make(map[int64][]m.SaleOrderLineSet)
+			for _, line := range other.OrderLine().Records() {
+				pending[line.Product().ID()] = append(pending[line.Product().ID()], line)
+			}
+			var res []saletypes.RevisionLineDiff
+			for _, line := range rs.OrderLine().Records() {
+				candidates := pending[line.Product().ID()]
+				if len(candidates) == 0 {
+					res = append(res, saletypes.RevisionLineDiff{
+						Product:     line.Product().NameGet(),
+						Change:      "removed",
+						OldQuantity: line.ProductUomQty(),
+						OldPrice:    line.PriceUnit(),
+						OldDiscount: line.Discount(),
+					})
+					continue
+				}
+				newLine := candidates[0]
+				pending[line.Product().ID()] = candidates[1:]
+				if newLine.ProductUomQty() == line.ProductUomQty() && newLine.PriceUnit() == line.PriceUnit() &&
+					newLine.Discount() == line.Discount() {
+					continue
+				}
+				res = append(res, saletypes.RevisionLineDiff{
+					Product:     line.Product().NameGet(),
+					Change:      "changed",
+					OldQuantity: line.ProductUomQty(),
+					NewQuantity: newLine.ProductUomQty(),
+					OldPrice:    line.PriceUnit(),
+					NewPrice:    newLine.PriceUnit(),
+					OldDiscount: line.Discount(),
+					NewDiscount: newLine.Discount(),
+				})
+			}
+			for _, line := range other.OrderLine().Records() {
+				for _, added := range pending[line.Product().ID()] {
+					if !added.Equals(line) {
+						continue
+					}
+					res = append(res, saletypes.RevisionLineDiff{
+						Product:     line.Product().NameGet(),
+						Change:      "added",
+						NewQuantity: line.ProductUomQty(),
+						NewPrice:    line.PriceUnit(),
+						NewDiscount: line.Discount(),
+					})
+				}
+			}
+			return res
+		})
+
+	h.SaleOrder().Methods().ComputeRevisionDiff().DeclareMethod(
+		`ComputeRevisionDiff describes the changes between this old revision and the current revision.`,
+		func(rs m.SaleOrderSet) m.SaleOrderData {
+			res := h.SaleOrder().NewData()
+			if !rs.IsOldRevision() {
+				return res
+			}
+			var msg []string
+			for _, diff := range rs.DiffRevision(rs.CurrentRevision()) {
+				switch diff.Change {
+				case "added":
+					msg = append(msg, rs.T("%s: added (quantity %s)", diff.Product, formatQuantity(diff.NewQuantity)))
+				case "removed":
+					msg = append(msg, rs.T("%s: removed (quantity %s)", diff.Product, formatQuantity(diff.OldQuantity)))
+				default:
+					msg = append(msg, rs.T("%s: quantity %s -> %s, unit price %s -> %s, discount %s%% -> %s%%",
+						diff.Product, formatQuantity(diff.OldQuantity), formatQuantity(diff.NewQuantity),
+						formatQuantity(diff.OldPrice), formatQuantity(diff.NewPrice),
+						formatQuantity(diff.OldDiscount), formatQuantity(diff.NewDiscount)))
+				}
+			}
+			return res.SetRevisionDiff(strings.Join(msg, "\n"))
+		})
+
+	h.SaleOrder().Methods().Write().Extend("",
+		func(rs m.SaleOrderSet, data m.SaleOrderData) bool {
+			rs.CheckRevisionWritable()
+			return rs.Super().Write(data)
+		})
+
+	h.SaleOrderLine().Methods().Create().Extend("",
+		func(rs m.SaleOrderLineSet, data m.SaleOrderLineData) m.SaleOrderLineSet {
+			if data.Order().IsNotEmpty() {
+				data.Order().CheckRevisionWritable()
+			}
+			return rs.Super().Create(data)
+		})
+
+	h.SaleOrderLine().Methods().Write().Extend("",
+		func(rs m.SaleOrderLineSet, data m.SaleOrderLineData) bool {
+			for _, line := range rs.Records() {
+				line.Order().CheckRevisionWritable()
+			}
+			return rs.Super().Write(data)
+		})
+
+	h.SaleOrderLine().Methods().Unlink().Extend("",
+		func(rs m.SaleOrderLineSet) int64 {
+			for _, line := range rs.Records() {
+				line.Order().CheckRevisionWritable()
+			}
+			return rs.Super().Unlink()
+		})
+
+}
@@ -77,6 +77,41 @@ func TestSale(t *testing.T) {
 				for _, invoice := range order.Invoices().Records() {
 					invoice.WithNewContext(ctx).InvoiceValidate()
 				}
+				So(order.PaymentStatus(), ShouldEqual, "not_paid")
+				So(order.Invoices().SaleOrders().Equals(order), ShouldBeTrue)
+				// I pay the invoice in two times, the second payment is the remaining amount
+				invoice := order.Invoices()
+				bankJournal := h.AccountJournal().Search(env, q.AccountJournal().Type().Equals("bank")).Limit(1)
+				invoice.PayAndReconcile(bankJournal, 2, dates.Date{}, h.AccountAccount().NewSet(env))
+				So(invoice.State(), ShouldEqual, "open")
+				So(order.PaymentStatus(), ShouldEqual, "partial")
+				logs := h.SaleOrderLog().Search(env, q.SaleOrderLog().Order().Equals(order).
+					And().Kind().Equals("payment"))
+				So(logs.Len(), ShouldEqual, 1)
+				So(logs.Message(), ShouldContainSubstring, "partially paid")
+				So(logs.NewValue(), ShouldEqual, formatAmount(invoice.Residual(), invoice.Currency()))
+				invoice.PayAndReconcile(bankJournal, 0, dates.Date{}, h.AccountAccount().NewSet(env))
+				So(invoice.State(), ShouldEqual, "paid")
+				So(order.PaymentStatus(), ShouldEqual, "paid")
+				logs = h.SaleOrderLog().Search(env, q.SaleOrderLog().Order().Equals(order).
+					And().Kind().Equals("payment").And().NewValue().Equals(invoice.Number()))
+				So(logs.Len(), ShouldEqual, 1)
+				So(logs.Message(), ShouldContainSubstring, "paid")
+				// I remove the payments, the invoice is open again
+				invoice.PaymentMoveLines().WithContext("invoice_id", invoice.ID()).RemoveMoveReconcile()
+				So(invoice.State(), ShouldEqual, "open")
+				So(order.PaymentStatus(), ShouldEqual, "not_paid")
+				logs = h.SaleOrderLog().Search(env, q.SaleOrderLog().Order().Equals(order).
+					And().Kind().Equals("payment").And().OldValue().Equals(invoice.Number()))
+				So(logs.Len(), ShouldEqual, 1)
+				// I pay and refund the invoice, the order is not paid anymore
+				invoice.PayAndReconcile(bankJournal, 0, dates.Date{}, h.AccountAccount().NewSet(env))
+				So(order.PaymentStatus(), ShouldEqual, "paid")
+				refund := invoice.Refund(dates.Today(), dates.Today(), "Refund", h.AccountJournal().NewSet(env))
+				refund.ActionInvoiceOpen()
+				So(refund.State(), ShouldEqual, "open")
+				So(order.Invoices().Intersect(refund).Equals(refund), ShouldBeTrue)
+				So(order.PaymentStatus(), ShouldEqual, "not_paid")
 			})
 		}), ShouldBeNil)
 	})
@@ -0,0 +1,245 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package sale
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hexya-addons/decimalPrecision"
+	"github.com/hexya-erp/hexya/src/actions"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/tools/nbutils"
+	"github.com/hexya-erp/hexya/src/views"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+func init() {
+
+	h.SaleOrderLine().AddFields(map[string]models.FieldDefinition{
+		"PriceManual": models.BooleanField{String: "Manual Price", ReadOnly: true, Index: true,
+			Help: `The unit price or the discount of this line have been set by hand and differ from the pricelist.
+They are kept when the quantity or the unit of measure of the line or the prices of the order are updated.`},
+	})
+
+	h.SaleOrderLine().Methods().PricelistPriceData().DeclareMethod(
+		`PricelistPriceData returns the unit price and the discount of this line computed from
+		the pricelist, the partner and the date of its order, as when the product or the quantity
+		is changed in the user interface.
+
+		The returned data is empty if the price cannot be computed.`,
+		func(rs m.SaleOrderLineSet) m.SaleOrderLineData {
+			rs.EnsureOne()
+			if rs.Product().IsEmpty() || rs.ProductUom().IsEmpty() ||
+				rs.Order().Pricelist().IsEmpty() || rs.Order().Partner().IsEmpty() {
+				return h.SaleOrderLine().NewData()
+			}
+			data := rs.UpdateOnchangeDiscount(h.SaleOrderLine().NewData().SetPriceUnit(rs.PricelistPriceUnit()))
+			if !data.HasDiscount() && rs.Order().Pricelist().DiscountPolicy() == "with_discount" {
+				// The discount of the pricelist is included in the price
+				data.SetDiscount(0)
+			}
+			return data
+		})
+
+	h.SaleOrderLine().Methods().PriceDiffersFromPricelist().DeclareMethod(
+		`PriceDiffersFromPricelist returns true if the unit price or the discount of this line
+		differ from those computed from the pricelist of its order. If the price cannot be computed,
+		the current value of the PriceManual field is returned.
+
+		The discount of the line before the global discount of the order was spread on it is compared.`,
+		func(rs m.SaleOrderLineSet) bool {
+			rs.EnsureOne()
+			data := rs.PricelistPriceData()
+			if !data.HasPriceUnit() {
+				return rs.PriceManual()
+			}
+			if nbutils.Compare(data.PriceUnit(), rs.PriceUnit(),
+				decimalPrecision.GetPrecision("Product Price").ToPrecision()) != 0 {
+				return true
+			}
+			discount := rs.Discount()
+			if rs.GlobalDiscountSpread() {
+				discount = rs.LineDiscount()
+			}
+			return data.HasDiscount() && nbutils.Compare(data.Discount(), discount,
+				decimalPrecision.GetPrecision("Discount").ToPrecision()) != 0
+		})
+
+	h.SaleOrderLine().Methods().UpdatePriceManual().DeclareMethod(
+		`UpdatePriceManual sets the PriceManual field of the lines of this RecordSet depending on
+		whether their price differs from their pricelist. Global discount lines and promotion
+		rewards are never flagged.`,
+		func(rs m.SaleOrderLineSet) {
+			for _, line := range rs.Records() {
+				if line.IsDiscountLine() || line.Promotion().IsNotEmpty() {
+					continue
+				}
+				if manual := line.PriceDiffersFromPricelist(); manual != line.PriceManual() {
+					line.Write(h.SaleOrderLine().NewData().SetPriceManual(manual))
+				}
+			}
+		})
+
+	h.SaleOrderLine().Methods().ActionResetPrice().DeclareMethod(
+		`ActionResetPrice sets back the unit price and the discount of the lines of this RecordSet
+		to those of the pricelist of their order.`,
+		func(rs m.SaleOrderLineSet) bool {
+			for _, line := range rs.Records() {
+				if line.State() != "draft" && line.State() != "sent" {
+					panic(rs.T("Prices can only be updated on quotations, but %s is not a quotation.", line.Order().Name()))
+				}
+				line.Write(line.PricelistPriceData().SetPriceManual(false))
+			}
+			return true
+		})
+
+	h.SaleOrderLine().Methods().ProductChange().Extend("",
+		func(rs m.SaleOrderLineSet) m.SaleOrderLineData {
+			data := rs.Super().ProductChange()
+			if data.HasPriceUnit() {
+				data.SetPriceManual(false)
+			}
+			return data
+		})
+
+	h.SaleOrderLine().Methods().ProductUomChange().Extend("",
+		func(rs m.SaleOrderLineSet) m.SaleOrderLineData {
+			if rs.PriceManual() {
+				return h.SaleOrderLine().NewData()
+			}
+			return rs.Super().ProductUomChange()
+		})
+
+	h.SaleOrderLine().Methods().Create().Extend("",
+		func(rs m.SaleOrderLineSet, data m.SaleOrderLineData) m.SaleOrderLineSet {
+			line := rs.Super().Create(data)
+			if !data.HasPriceManual() && (data.HasPriceUnit() || data.HasDiscount()) {
+				line.UpdatePriceManual()
+			}
+			return line
+		})
+
+	h.SaleOrderLine().Methods().Write().Extend("",
+		func(rs m.SaleOrderLineSet, data m.SaleOrderLineData) bool {
+			if !data.HasPriceManual() {
+				res := rs.Super().Write(data)
+				if (data.HasPriceUnit() || data.HasDiscount()) && !rs.Env().Context().GetBool("sale_global_discount") {
+					rs.UpdatePriceManual()
+				}
+				return res
+			}
+			var logs []m.SaleOrderLogData
+			var orders []m.SaleOrderSet
+			for _, line := range rs.Records() {
+				if data.PriceManual() == line.PriceManual() {
+					continue
+				}
+				msg := rs.T("%s: Price set manually", line.Product().NameGet())
+				if !data.PriceManual() {
+					msg = rs.T("%s: Price set from the pricelist", line.Product().NameGet())
+				}
+				logs = append(logs, h.SaleOrderLog().NewData().
+					SetOrderLine(line).
+					SetKind("price_manual").
+					SetOldValue(strconv.FormatBool(line.PriceManual())).
+					SetNewValue(strconv.FormatBool(data.PriceManual())).
+					SetMessage(msg))
+				orders = append(orders, line.Order())
+			}
+			res := rs.Super().Write(data)
+			for i, logData := range logs {
+				orders[i].LogChange(logData)
+			}
+			return res
+		})
+
+	h.SaleOrderLine().Methods().UpdatePrices().DeclareMethod(
+		`UpdatePrices sets the unit price and the discount of the lines of this RecordSet
+		from the pricelist of their order.
+
+		Lines with a manual price, global discount lines and promotion rewards are left untouched.
+		It returns the lines whose price or discount has changed.`,
+		func(rs m.SaleOrderLineSet) m.SaleOrderLineSet {
+			pricePrecision := decimalPrecision.GetPrecision("Product Price").ToPrecision()
+			discountPrecision := decimalPrecision.GetPrecision("Discount").ToPrecision()
+			changed := h.SaleOrderLine().NewSet(rs.Env())
+			for _, line := range rs.Records() {
+				if line.PriceManual() || line.IsDiscountLine() || line.Promotion().IsNotEmpty() {
+					continue
+				}
+				data := line.PricelistPriceData()
+				if data.HasPriceUnit() && nbutils.Compare(data.PriceUnit(), line.PriceUnit(), pricePrecision) == 0 {
+					data.UnsetPriceUnit()
+				}
+				if data.HasDiscount() && nbutils.Compare(data.Discount(), line.Discount(), discountPrecision) == 0 {
+					data.UnsetDiscount()
+				}
+				if !data.HasPriceUnit() && !data.HasDiscount() {
+					continue
+				}
+				line.Write(data)
+				changed = changed.Union(line)
+			}
+			return changed
+		})
+
+	h.SaleOrder().Methods().UpdatePrices().DeclareMethod(
+		`UpdatePrices sets the unit price and the discount of the lines of the quotations of
+		this RecordSet from their current pricelist. Lines with a manual price are kept.
+
+		The global discount and the promotions of the quotations are applied again afterwards.
+		It returns the lines whose price or discount has changed. Each change is recorded in
+		the history of its order.`,
+		func(rs m.SaleOrderSet) m.SaleOrderLineSet {
+			for _, order := range rs.Records() {
+				if order.State() != "draft" && order.State() != "sent" {
+					panic(rs.T("Prices can only be updated on quotations, but %s is not a quotation.", order.Name()))
+				}
+			}
+			changed := h.SaleOrderLine().NewSet(rs.Env())
+			for _, order := range rs.Records() {
+				globalDiscount := order.GlobalDiscount() != 0 || order.DiscountLines().IsNotEmpty()
+				if globalDiscount {
+					// Lines on which the global discount is spread get their own discount back first
+					order.ResetGlobalDiscount()
+				}
+				// The global discount is applied once all the prices are updated
+				changed = changed.Union(order.OrderLine().WithContext("sale_global_discount", true).UpdatePrices())
+				if globalDiscount {
+					order.ApplyGlobalDiscount()
+				}
+				if order.RewardLines().IsNotEmpty() {
+					order.ApplyPromotions()
+				}
+			}
+			return changed
+		})
+
+	h.SaleOrder().Methods().ActionUpdatePrices().DeclareMethod(
+		`ActionUpdatePrices updates the prices of the quotations of this RecordSet from their
+		pricelist and returns an action listing the lines whose price has changed.`,
+		func(rs m.SaleOrderSet) *actions.Action {
+			changed := rs.UpdatePrices()
+			if changed.IsEmpty() {
+				return &actions.Action{Type: actions.ActionCloseWindow}
+			}
+			idsStr := make([]string, changed.Len())
+			for i, line := range changed.Records() {
+				idsStr[i] = strconv.FormatInt(line.ID(), 10)
+			}
+			return &actions.Action{
+				Type:   actions.ActionActWindow,
+				Name:   rs.T("Updated Prices"),
+				Model:  "SaleOrderLine",
+				View:   views.MakeViewRef("sale_view_order_line_tree"),
+				Views:  []views.ViewTuple{{ID: "sale_view_order_line_tree", Type: views.ViewTypeTree}},
+				Domain: fmt.Sprintf("[('id', 'in', (%s))]", strings.Join(idsStr, ",")),
+				Target: "new",
+			}
+		})
+
+}
@@ -0,0 +1,161 @@
+// Copyright 2017 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package saletypes
+
+// A LayoutSection holds the lines of a document that belong
+// to the same sale layout category.
+type LayoutSection struct {
+	Name           string
+	Subtotal       bool
+	SubtotalAmount float64
+	Pagebreak      bool
+	// Default is true for the section of the lines without layout category
+	Default bool
+	// LineIDs are the IDs of the lines of the section, in the order of the document.
+	// Use the LayoutSectionLines method of the document to get them as a RecordSet.
+	LineIDs []int64
+}
+
+// A LayoutPage is a list of sections to be rendered on the same page
+// of a document.
+type LayoutPage []LayoutSection
+
+// A MailAttachment is a file attached to a MailMessage.
+type MailAttachment struct {
+	Name        string
+	ContentType string
+	Content     []byte
+}
+
+// A MailMessage is an e-mail message ready to be dispatched by a MailTransport.
+type MailMessage struct {
+	From        string
+	To          []string
+	Subject     string
+	Body        string
+	Attachments []MailAttachment
+}
+
+// A MailTransport dispatches e-mail messages.
+//
+// Send must return a non nil error if the message could not be dispatched.
+type MailTransport interface {
+	Send(msg MailMessage) error
+}
+
+// A SaleWarning is a message to display to the user when selecting
+// a customer or a product on a sale order.
+//
+// If Blocking is true, the customer or product cannot be sold.
+type SaleWarning struct {
+	Title    string
+	Message  string
+	Blocking bool
+}
+
+// IsEmpty returns true if this SaleWarning has no message to display.
+func (sw SaleWarning) IsEmpty() bool {
+	return sw.Title == ""
+}
+
+// A CreditLimitError is the error raised when confirming an order would
+// exceed the credit limit of the customer.
+type CreditLimitError struct {
+	// Partner is the name of the commercial partner whose limit is exceeded
+	Partner string
+	// Limit is the credit limit of the partner
+	Limit float64
+	// Exposure is the amount the partner would owe if the order was confirmed
+	Exposure float64
+	// Message is the translated description of the error
+	Message string
+}
+
+// Error returns the message of this CreditLimitError
+func (e CreditLimitError) Error() string {
+	return e.Message
+}
+
+// A RevisionLineDiff describes how a line differs between two revisions of a quotation.
+type RevisionLineDiff struct {
+	// Product is the display name of the product of the line
+	Product string
+	// Change is one of "added", "removed" or "changed"
+	Change      string
+	OldQuantity float64
+	NewQuantity float64
+	OldPrice    float64
+	NewPrice    float64
+	OldDiscount float64
+	NewDiscount float64
+}
+
+// A PriceBreakdownStep is a pricelist item applied when computing the price of a sale order line.
+type PriceBreakdownStep struct {
+	// Pricelist is the name of the pricelist of the item
+	Pricelist string
+	// Item is the name of the pricelist item
+	Item string
+	// Rule is the description of the computation of the item (e.g. "10% discount")
+	Rule string
+	// Base is the base of the item: "ListPrice", "StandardPrice" or "pricelist"
+	Base string
+	// Price is the price given by the item, in the currency of its pricelist
+	Price float64
+}
+
+// A PriceBreakdown explains how the unit price and the discount of a sale order line
+// are computed from its product, its pricelist, the currencies and the units of measure.
+type PriceBreakdown struct {
+	Product   string
+	Pricelist string
+	// DiscountPolicy is the discount policy of the pricelist of the order:
+	// "with_discount" or "without_discount"
+	DiscountPolicy string
+	Quantity       float64
+	Uom            string
+	// BaseField is the product field the price is computed from:
+	// "LstPrice", "StandardPrice" or "Price" (price of another pricelist)
+	BaseField string
+	// BasePrice is the value of BaseField, in the product currency and unit of measure
+	BasePrice float64
+	// Steps are the pricelist items applied, from the pricelist of the order
+	// to the last pricelist it is based on
+	Steps []PriceBreakdownStep
+	// UomFactor converts the base price from the unit of measure of the product
+	// to the unit of measure of the line
+	UomFactor float64
+	// ProductCurrency is the currency of the base price
+	ProductCurrency string
+	// Currency is the currency of the pricelist of the order
+	Currency string
+	// CurrencyRate converts the base price from ProductCurrency to Currency
+	CurrencyRate float64
+	// ListPrice is the price before the pricelist is applied, in the currency of the
+	// pricelist and the unit of measure of the line
+	ListPrice float64
+	// PricelistPrice is the price computed by the pricelist
+	PricelistPrice float64
+	// Discount is the discount given by the pricelist, if the pricelist shows discounts
+	Discount float64
+	// PriceUnit is the unit price proposed for the line
+	PriceUnit float64
+	// CurrentPriceUnit and CurrentDiscount are the actual unit price and discount of the line,
+	// which may have been modified by hand
+	CurrentPriceUnit float64
+	CurrentDiscount  float64
+}
+
+// A PriceLadderStep is the price of a product from a given quantity under a pricelist.
+type PriceLadderStep struct {
+	// MinQuantity is the quantity from which this step applies, in the unit of measure of the line
+	MinQuantity float64
+	// PriceUnit and Discount are the unit price and the discount the line would get
+	PriceUnit float64
+	Discount  float64
+	// Price is the unit price after discount
+	Price float64
+	// Current is true for the step that applies to the current quantity of the line
+	Current bool
+}
@@ -5,6 +5,7 @@ package sale
 
 import (
 	"github.com/hexya-addons/account"
+	"github.com/hexya-addons/base"
 	"github.com/hexya-addons/saleTeams"
 	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/pool/h"
@@ -29,6 +30,10 @@ var (
 	GroupWarningSale *security.Group
 	// GroupAnalyticAccounting enables analytic accounting for sales
 	GroupAnalyticAccounting *security.Group
+	// GroupSaleMargin shows the cost and margin of sale orders and lines
+	GroupSaleMargin *security.Group
+	// GroupSalePriceOverride allows selling below the floor price of products
+	GroupSalePriceOverride *security.Group
 )
 
 func init() {
@@ -41,6 +46,8 @@ func init() {
 	GroupDisplayIncoterms = security.Registry.NewGroup("sale_group_display_incoterm", "Display incoterms on Sales Order and related invoices")
 	GroupWarningSale = security.Registry.NewGroup("sale_group_warning_sale", "A warning can be set on a product or a customer (Sale)")
 	GroupAnalyticAccounting = security.Registry.NewGroup("sale_group_analytic_accounting", "Analytic Accounting for Sales")
+	GroupSaleMargin = security.Registry.NewGroup("sale_group_sale_margin", "Show margins on sales orders")
+	GroupSalePriceOverride = security.Registry.NewGroup("sale_group_price_override", "Sell below floor prices")
 
 	h.SaleOrder().Methods().Load().AllowGroup(saleTeams.GroupSaleSalesman)
 	h.SaleOrder().Methods().Write().AllowGroup(saleTeams.GroupSaleSalesman)
@@ -98,5 +105,32 @@ func init() {
 	h.AccountInvoiceTax().Methods().Load().AllowGroup(saleTeams.GroupSaleSalesman)
 	h.AccountTaxGroup().Methods().Load().AllowGroup(saleTeams.GroupSaleSalesman)
 	h.AccountAccount().Methods().Load().AllowGroup(saleTeams.GroupSaleManager)
+	h.SaleConfigSettings().Methods().AllowAllToGroup(base.GroupSystem)
+	h.SaleMail().Methods().AllowAllToGroup(saleTeams.GroupSaleSalesman)
+	h.SaleMail().Methods().AllowAllToGroup(saleTeams.GroupSaleManager)
+	h.SaleOrderLog().Methods().Load().AllowGroup(saleTeams.GroupSaleSalesman)
+	h.SaleOrderLog().Methods().Load().AllowGroup(saleTeams.GroupSaleManager)
+	h.SaleOrderLog().Methods().Load().AllowGroup(account.GroupAccountInvoice)
+	h.SaleApprovalRule().Methods().AllowAllToGroup(saleTeams.GroupSaleManager)
+	h.SaleApprovalRule().Methods().Load().AllowGroup(saleTeams.GroupSaleSalesman)
+	h.SaleOrderApproval().Methods().Load().AllowGroup(saleTeams.GroupSaleSalesman)
+	h.SaleOrderApproval().Methods().Load().AllowGroup(saleTeams.GroupSaleManager)
+	h.SaleCancelReason().Methods().AllowAllToGroup(saleTeams.GroupSaleManager)
+	h.SaleCancelReason().Methods().Load().AllowGroup(saleTeams.GroupSaleSalesman)
+	h.SaleCancelReason().Methods().Load().AllowGroup(account.GroupAccountInvoice)
+	h.SaleCancelWizard().Methods().AllowAllToGroup(saleTeams.GroupSaleSalesman)
+	h.SaleCancelWizard().Methods().AllowAllToGroup(saleTeams.GroupSaleManager)
+	h.SaleOrderTemplate().Methods().AllowAllToGroup(saleTeams.GroupSaleManager)
+	h.SaleOrderTemplate().Methods().Load().AllowGroup(saleTeams.GroupSaleSalesman)
+	h.SaleOrderTemplateLine().Methods().AllowAllToGroup(saleTeams.GroupSaleManager)
+	h.SaleOrderTemplateLine().Methods().Load().AllowGroup(saleTeams.GroupSaleSalesman)
+	h.SalePromotion().Methods().AllowAllToGroup(saleTeams.GroupSaleManager)
+	h.SalePromotion().Methods().Load().AllowGroup(saleTeams.GroupSaleSalesman)
+	h.SaleCoupon().Methods().AllowAllToGroup(saleTeams.GroupSaleManager)
+	h.SaleCoupon().Methods().Load().AllowGroup(saleTeams.GroupSaleSalesman)
+	h.SaleCouponWizard().Methods().AllowAllToGroup(saleTeams.GroupSaleSalesman)
+	h.SaleCouponWizard().Methods().AllowAllToGroup(saleTeams.GroupSaleManager)
+	h.SalePriceBreakdown().Methods().AllowAllToGroup(saleTeams.GroupSaleSalesman)
+	h.SalePriceBreakdown().Methods().AllowAllToGroup(saleTeams.GroupSaleManager)
 
 }
@@ -34,3 +34,18 @@ KanbanRecord.include({
 });
 
 });
+
+hexya.define('sale.report', function (require) {
+"use strict";
+
+var core = require('web.core');
+
+/**
+ * Client action opening the sale order report given in the
+ * 'report_url' key of the action context in a new window.
+ */
+core.action_registry.add('sale.report', function (parent, action) {
+    window.open(action.context.report_url, '_blank');
+});
+
+});